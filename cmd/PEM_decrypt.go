@@ -9,8 +9,11 @@ import (
 	"encoding/pem"
 	"errors"
 	"io"
+	"strconv"
 	"strings"
 
+	"golang.org/x/crypto/pbkdf2"
+
 	"github.com/RyuaNerin/go-krypto/aria"
 	"github.com/emmansun/gmsm/sm4"
 	"github.com/pedroalbanese/anubis"
@@ -18,6 +21,7 @@ import (
 	"github.com/pedroalbanese/cast5"
 	"github.com/pedroalbanese/go-idea"
 	"github.com/pedroalbanese/go-krcrypt"
+	"github.com/pedroalbanese/gogost/mgm"
 	"github.com/pedroalbanese/kuznechik"
 )
 
@@ -42,6 +46,9 @@ const (
 	PEMCipherGOST
 	PEMCipherCAST
 	PEMCipherANUBIS
+	PEMCipherAES128GCM
+	PEMCipherAES256GCM
+	PEMCipherKUZNECHIKMGM
 )
 
 type rfc1423Algo struct {
@@ -50,6 +57,12 @@ type rfc1423Algo struct {
 	cipherFunc func(key []byte) (cipher.Block, error)
 	keySize    int
 	blockSize  int
+
+	// Authenticated modes: the key is derived with PBKDF2 and the -kdf
+	// function named by kdf, with the iterations and salt in DEK-Info.
+	aead      func(cipher.Block) (cipher.AEAD, error)
+	nonceSize int
+	kdf       string
 }
 
 var rfc1423Algos = []rfc1423Algo{{
@@ -142,12 +155,6 @@ var rfc1423Algos = []rfc1423Algo{{
 	cipherFunc: krcrypt.NewSEED,
 	keySize:    16,
 	blockSize:  16,
-}, {
-	cipher:     PEMCipherSEED,
-	name:       "SEED-CBC",
-	cipherFunc: krcrypt.NewSEED,
-	keySize:    16,
-	blockSize:  16,
 }, {
 	cipher:     PEMCipherCAST,
 	name:       "CAST-CBC",
@@ -155,11 +162,42 @@ var rfc1423Algos = []rfc1423Algo{{
 	keySize:    16,
 	blockSize:  8,
 }, {
+	// Anubis takes 128 to 320-bit keys, but ANUBIS-CBC has always
+	// derived a 128-bit one; a longer key would not read existing files.
 	cipher:     PEMCipherANUBIS,
 	name:       "ANUBIS-CBC",
 	cipherFunc: anubis.New,
 	keySize:    16,
 	blockSize:  16,
+}, {
+	cipher:     PEMCipherAES128GCM,
+	name:       "AES-128-GCM",
+	cipherFunc: aes.NewCipher,
+	keySize:    16,
+	blockSize:  aes.BlockSize,
+	aead:       cipher.NewGCM,
+	nonceSize:  12,
+	kdf:        "pbkdf2",
+}, {
+	cipher:     PEMCipherAES256GCM,
+	name:       "AES-256-GCM",
+	cipherFunc: aes.NewCipher,
+	keySize:    32,
+	blockSize:  aes.BlockSize,
+	aead:       cipher.NewGCM,
+	nonceSize:  12,
+	kdf:        "pbkdf2",
+}, {
+	cipher:     PEMCipherKUZNECHIKMGM,
+	name:       "KUZNECHIK-MGM",
+	cipherFunc: kuznechik.NewCipher,
+	keySize:    32,
+	blockSize:  kuznechik.BlockSize,
+	aead: func(block cipher.Block) (cipher.AEAD, error) {
+		return mgm.NewMGM(block, block.BlockSize())
+	},
+	nonceSize: kuznechik.BlockSize,
+	kdf:       "pbkdf2-streebog",
 },
 }
 
@@ -179,6 +217,60 @@ func (c rfc1423Algo) deriveKey(password, salt []byte) []byte {
 	return out
 }
 
+// newAEAD derives the key of an authenticated mode from the password.
+func (c rfc1423Algo) newAEAD(password, salt []byte, iterations int) (cipher.AEAD, error) {
+	for _, prf := range pbkdf2PRFs {
+		if prf.name == c.kdf {
+			block, err := c.cipherFunc(pbkdf2.Key(password, salt, iterations, c.keySize, prf.hash))
+			if err != nil {
+				return nil, err
+			}
+			return c.aead(block)
+		}
+	}
+	return nil, errors.New("x509: unknown key derivation function " + c.kdf)
+}
+
+// dekInfo is a parsed DEK-Info header. The CBC modes have "MODE,IV". The
+// authenticated modes add their key derivation, "MODE,nonce,iterations,salt".
+type dekInfo struct {
+	alg        *rfc1423Algo
+	iv         []byte
+	iterations int
+	salt       []byte
+}
+
+func parseDEKInfo(dek string) (*dekInfo, error) {
+	fields := strings.Split(dek, ",")
+	if len(fields) < 2 {
+		return nil, errors.New("x509: malformed DEK-Info header")
+	}
+	alg := cipherByName(fields[0])
+	if alg == nil {
+		return nil, errors.New("x509: unknown encryption mode")
+	}
+	iv, err := hex.DecodeString(fields[1])
+	if err != nil {
+		return nil, err
+	}
+	info := &dekInfo{alg: alg, iv: iv}
+	switch {
+	case alg.aead != nil && len(fields) == 4:
+		iterations, err := strconv.Atoi(fields[2])
+		if err != nil || iterations <= 0 || iterations > maxPBKDF2Iterations {
+			return nil, errors.New("x509: invalid PBKDF2 iteration count")
+		}
+		salt, err := hex.DecodeString(fields[3])
+		if err != nil || len(salt) == 0 {
+			return nil, errors.New("x509: invalid PBKDF2 salt")
+		}
+		info.iterations, info.salt = iterations, salt
+	case alg.aead != nil || len(fields) != 2:
+		return nil, errors.New("x509: malformed DEK-Info header")
+	}
+	return info, nil
+}
+
 func IsEncryptedPEMBlock(b *pem.Block) bool {
 	_, ok := b.Headers["DEK-Info"]
 	return ok
@@ -192,20 +284,14 @@ func DecryptPEMBlock(b *pem.Block, password []byte) ([]byte, error) {
 		return nil, errors.New("x509: no DEK-Info header in block")
 	}
 
-	idx := strings.Index(dek, ",")
-	if idx == -1 {
-		return nil, errors.New("x509: malformed DEK-Info header")
-	}
-
-	mode, hexIV := dek[:idx], dek[idx+1:]
-	ciph := cipherByName(mode)
-	if ciph == nil {
-		return nil, errors.New("x509: unknown encryption mode")
-	}
-	iv, err := hex.DecodeString(hexIV)
+	info, err := parseDEKInfo(dek)
 	if err != nil {
 		return nil, err
 	}
+	ciph, iv := info.alg, info.iv
+	if ciph.aead != nil {
+		return ciph.open(b, password, info)
+	}
 	if len(iv) != ciph.blockSize {
 		return nil, errors.New("x509: incorrect IV size")
 	}
@@ -224,15 +310,43 @@ func DecryptPEMBlock(b *pem.Block, password []byte) ([]byte, error) {
 	dec := cipher.NewCBCDecrypter(block, iv)
 	dec.CryptBlocks(data, b.Bytes)
 
+	return unpad(data, ciph.blockSize)
+}
+
+// open decrypts and authenticates a block in an authenticated mode, with
+// the PEM type as additional data. Any change to the data, and a wrong
+// password, make authentication fail.
+func (c rfc1423Algo) open(b *pem.Block, password []byte, info *dekInfo) ([]byte, error) {
+	nonce := info.iv
+	if len(nonce) != c.nonceSize {
+		return nil, errors.New("x509: incorrect IV size")
+	}
+	if c.cipher == PEMCipherKUZNECHIKMGM && nonce[0]&0x80 != 0 {
+		return nil, errors.New("x509: invalid MGM nonce")
+	}
+	aead, err := c.newAEAD(password, info.salt, info.iterations)
+	if err != nil {
+		return nil, err
+	}
+	data, err := aead.Open(nil, nonce, b.Bytes, []byte(b.Type))
+	if err != nil {
+		return nil, IncorrectPasswordError
+	}
+	return data, nil
+}
+
+// unpad removes the PKCS#7 padding of decrypted CBC data. Bad padding
+// almost always means a wrong password.
+func unpad(data []byte, blockSize int) ([]byte, error) {
 	dlen := len(data)
-	if dlen == 0 || dlen%ciph.blockSize != 0 {
+	if dlen == 0 || dlen%blockSize != 0 {
 		return nil, errors.New("x509: invalid padding")
 	}
 	last := int(data[dlen-1])
 	if dlen < last {
 		return nil, IncorrectPasswordError
 	}
-	if last == 0 || last > ciph.blockSize {
+	if last == 0 || last > blockSize {
 		return nil, IncorrectPasswordError
 	}
 	for _, val := range data[dlen-last:] {
@@ -243,11 +357,25 @@ func DecryptPEMBlock(b *pem.Block, password []byte) ([]byte, error) {
 	return data[:dlen-last], nil
 }
 
+// pad appends PKCS#7 padding to data before CBC encryption.
+func pad(data []byte, blockSize int) []byte {
+	n := blockSize - len(data)%blockSize
+	padded := make([]byte, len(data), len(data)+n)
+	copy(padded, data)
+	for i := 0; i < n; i++ {
+		padded = append(padded, byte(n))
+	}
+	return padded
+}
+
 func EncryptPEMBlock(rand io.Reader, blockType string, data, password []byte, alg PEMCipher) (*pem.Block, error) {
 	ciph := cipherByKey(alg)
 	if ciph == nil {
 		return nil, errors.New("x509: unknown encryption mode")
 	}
+	if ciph.aead != nil {
+		return ciph.seal(rand, blockType, data, password)
+	}
 	iv := make([]byte, ciph.blockSize)
 	if _, err := io.ReadFull(rand, iv); err != nil {
 		return nil, errors.New("x509: cannot generate IV: " + err.Error())
@@ -258,12 +386,7 @@ func EncryptPEMBlock(rand io.Reader, blockType string, data, password []byte, al
 		return nil, err
 	}
 	enc := cipher.NewCBCEncrypter(block, iv)
-	pad := ciph.blockSize - len(data)%ciph.blockSize
-	encrypted := make([]byte, len(data), len(data)+pad)
-	copy(encrypted, data)
-	for i := 0; i < pad; i++ {
-		encrypted = append(encrypted, byte(pad))
-	}
+	encrypted := pad(data, ciph.blockSize)
 	enc.CryptBlocks(encrypted, encrypted)
 
 	return &pem.Block{
@@ -276,6 +399,34 @@ func EncryptPEMBlock(rand io.Reader, blockType string, data, password []byte, al
 	}, nil
 }
 
+// seal encrypts a block in an authenticated mode under a random nonce and
+// a separate random salt.
+func (c rfc1423Algo) seal(rand io.Reader, blockType string, data, password []byte) (*pem.Block, error) {
+	nonce := make([]byte, c.nonceSize)
+	if _, err := io.ReadFull(rand, nonce); err != nil {
+		return nil, errors.New("x509: cannot generate IV: " + err.Error())
+	}
+	if c.cipher == PEMCipherKUZNECHIKMGM {
+		nonce[0] &= 0x7F // MGM nonces have the top bit clear
+	}
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand, salt); err != nil {
+		return nil, errors.New("x509: cannot generate salt: " + err.Error())
+	}
+	aead, err := c.newAEAD(password, salt, pbkdf2Iterations)
+	if err != nil {
+		return nil, err
+	}
+	return &pem.Block{
+		Type: blockType,
+		Headers: map[string]string{
+			"Proc-Type": "4,ENCRYPTED",
+			"DEK-Info":  c.name + "," + hex.EncodeToString(nonce) + "," + strconv.Itoa(pbkdf2Iterations) + "," + hex.EncodeToString(salt),
+		},
+		Bytes: aead.Seal(nil, nonce, data, []byte(blockType)),
+	}, nil
+}
+
 func cipherByName(name string) *rfc1423Algo {
 	for i := range rfc1423Algos {
 		alg := &rfc1423Algos[i]
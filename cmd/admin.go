@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Time the server started, reported by STATS
+var startTime = time.Now()
+
+// startAdminSocket listens for admin commands on a Unix socket that only
+// the server's user can access. Each connection carries one command line;
+// the reply ends with a line reading "OK" or "ERR <reason>".
+func startAdminSocket(path string) error {
+	listener, err := listenPrivate(path)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				logError("admin socket closed", "error", err)
+				return
+			}
+			go handleAdmin(conn)
+		}
+	}()
+	return nil
+}
+
+func handleAdmin(conn net.Conn) {
+	defer conn.Close()
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+	reply, err := adminCommand(strings.TrimSpace(line))
+	conn.Write([]byte(reply))
+	if err != nil {
+		fmt.Fprintln(conn, "ERR", err)
+		return
+	}
+	fmt.Fprintln(conn, "OK")
+}
+
+// adminCommand runs one admin command and returns its output.
+func adminCommand(line string) (string, error) {
+	command, args, _ := strings.Cut(line, " ")
+	args = strings.TrimSpace(args)
+
+	switch strings.ToUpper(command) {
+	case "CLIENTS":
+		var out string
+		for _, client := range hub.connected() {
+			out += fmt.Sprintf("%s keyid=%s skid=%s akid=%s ip=%s session=%d oper=%t\n",
+				client.name(), client.keyID, getClientSKID(client.clientCert), getClientAKID(client.clientCert),
+				client.conn.RemoteAddr(), client.id, client.oper)
+		}
+		return out, nil
+	case "ROOMS":
+		var out string
+		for _, room := range hub.roomList() {
+			var names []string
+			for _, client := range room.members() {
+				names = append(names, client.name())
+			}
+			out += fmt.Sprintf("%s %s\n", room.name, strings.Join(names, " "))
+		}
+		return out, nil
+	case "KICK":
+		nick, reason, _ := strings.Cut(args, " ")
+		target := hub.findClient(nick)
+		if target == nil {
+			return "", fmt.Errorf("no such user: %s", nick)
+		}
+		if reason == "" {
+			reason = "no reason given"
+		}
+		auditOper("admin-socket", "kill", "target", target.name(), "keyid", target.keyID, "reason", reason)
+		killUser(target, "the server administrator", reason)
+		return "", nil
+	case "REVOKE":
+		serial, ok := new(big.Int).SetString(strings.TrimPrefix(strings.ToLower(args), "0x"), 16)
+		if !ok {
+			return "", fmt.Errorf("invalid serial number: %s", args)
+		}
+		revokeSerial(serial)
+		auditOper("admin-socket", "revoke", "serial", fmt.Sprintf("%X", serial))
+
+		// Certificates of the built-in CA are also revoked in its index and CRL
+		var out string
+		if serverCA != nil {
+			err := serverCA.revoke(serial, 30)
+			if err == nil {
+				err = loadServerPKI()
+				out += "CRL updated\n"
+			}
+			if err != nil && !errors.Is(err, errNotIssued) {
+				return out, err
+			}
+		}
+
+		// Disconnect the sessions using the revoked certificate
+		for _, client := range hub.connected() {
+			if client.clientCert.SerialNumber.Cmp(serial) == 0 {
+				client.send("Your certificate has been revoked. Please contact the certificate authority.\n")
+				hub.unregister(client)
+				out += "disconnected " + client.name() + "\n"
+			}
+		}
+		return out, nil
+	case "RELOAD":
+		if err := loadServerPKI(); err != nil {
+			return "", err
+		}
+		auditOper("admin-socket", "reload")
+		return "", nil
+	case "ENROLLMENTS":
+		return listEnrollments(), nil
+	case "APPROVE", "REJECT":
+		if serverCA == nil {
+			return "", errors.New("enrollment is not enabled")
+		}
+		id, err := strconv.ParseUint(args, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid enrollment id: %s", args)
+		}
+		if strings.ToUpper(command) == "REJECT" {
+			if err := rejectEnrollment(id); err != nil {
+				return "", err
+			}
+			auditOper("admin-socket", "reject", "id", args)
+			return "", nil
+		}
+		cert, err := approveEnrollment(id)
+		if err != nil {
+			return "", err
+		}
+		auditOper("admin-socket", "approve", "id", args, "serial", fmt.Sprintf("%X", cert.SerialNumber), "subject", cert.Subject.String())
+		return fmt.Sprintf("issued %X %s\n", cert.SerialNumber, cert.Subject), nil
+	case "STATS":
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		return fmt.Sprintf("uptime %s\nclients %d\nrooms %d\ngoroutines %d\nheap_bytes %d\n",
+			time.Since(startTime).Round(time.Second), len(hub.connected()), len(hub.roomList()),
+			runtime.NumGoroutine(), mem.HeapAlloc), nil
+	}
+	return "", fmt.Errorf("unknown command: %s", command)
+}
+
+// ircsctl sends one command to the admin socket of a running server and
+// prints the reply.
+func ircsctl(args []string) {
+	fs := flag.NewFlagSet("ircsctl", flag.ExitOnError)
+	socket := fs.String("admin", "", "Admin control socket path.")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage of ircsctl: [-admin path] <CLIENTS|ROOMS|KICK nick [reason]|REVOKE serial|RELOAD|STATS|ENROLLMENTS|APPROVE id|REJECT id>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *socket == "" || fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	conn, err := net.Dial("unix", *socket)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintln(conn, strings.Join(fs.Args(), " "))
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "OK" {
+			return
+		}
+		if strings.HasPrefix(line, "ERR") {
+			fmt.Fprintln(os.Stderr, strings.TrimSpace(strings.TrimPrefix(line, "ERR")))
+			os.Exit(1)
+		}
+		fmt.Println(line)
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatal(err)
+	}
+}
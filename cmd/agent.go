@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The key agent keeps private keys in memory, decrypted once, and signs
+// with them for clients and servers started with "-key agent:<socket>", in
+// the manner of ssh-agent. Each connection carries one request line:
+//
+//	KEYS                                    -> "<fingerprint> <base64 SPKI>" lines
+//	SIGN <fingerprint> <hash> <salt|-> <base64 digest> -> the base64 signature
+//
+// followed by a line reading "OK" (or "OK <signature>") or "ERR <reason>".
+// The fingerprint is the SHA-256 of the SubjectPublicKeyInfo in hex; salt
+// is the RSA-PSS salt length, or "-" for other signatures.
+
+// agentSigner is a crypto.Signer whose private key is held by an agent.
+type agentSigner struct {
+	socket      string
+	fingerprint string
+	public      crypto.PublicKey
+}
+
+func spkiFingerprint(spki []byte) string {
+	sum := sha256.Sum256(spki)
+	return hex.EncodeToString(sum[:])
+}
+
+// agentRequest sends one request to the agent at socket and returns the
+// lines of its reply before "OK", and the text after "OK".
+func agentRequest(socket, request string) ([]string, string, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, "", err
+	}
+	defer conn.Close()
+
+	if _, err := fmt.Fprintln(conn, request); err != nil {
+		return nil, "", err
+	}
+	var lines []string
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "OK" || strings.HasPrefix(line, "OK "):
+			return lines, strings.TrimPrefix(strings.TrimPrefix(line, "OK"), " "), nil
+		case strings.HasPrefix(line, "ERR "):
+			return nil, "", errors.New("agent: " + strings.TrimPrefix(line, "ERR "))
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, "", err
+	}
+	return nil, "", io.ErrUnexpectedEOF
+}
+
+// loadAgentKey connects to the agent of an "agent:<socket>[?key=<prefix>]"
+// URI and selects the key whose fingerprint starts with prefix, or its only
+// key.
+func loadAgentKey(uri string) (crypto.Signer, error) {
+	socket, query, _ := strings.Cut(strings.TrimPrefix(uri, "agent:"), "?")
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.ToLower(values.Get("key"))
+
+	lines, _, err := agentRequest(socket, "KEYS")
+	if err != nil {
+		return nil, err
+	}
+	var found []*agentSigner
+	for _, line := range lines {
+		fingerprint, encoded, _ := strings.Cut(line, " ")
+		if !strings.HasPrefix(fingerprint, prefix) {
+			continue
+		}
+		der, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		public, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, &agentSigner{socket: socket, fingerprint: fingerprint, public: public})
+	}
+	switch {
+	case len(found) == 0:
+		return nil, errors.New("agent: no such key")
+	case len(found) > 1:
+		return nil, fmt.Errorf("agent: %d keys match, select one with ?key=<fingerprint>", len(found))
+	}
+	return found[0], nil
+}
+
+func (s *agentSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+func (s *agentSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	salt := "-"
+	if pss, ok := opts.(*rsa.PSSOptions); ok {
+		salt = strconv.Itoa(pss.SaltLength)
+	}
+	request := fmt.Sprintf("SIGN %s %d %s %s", s.fingerprint, uint(opts.HashFunc()), salt,
+		base64.StdEncoding.EncodeToString(digest))
+	_, signature, err := agentRequest(s.socket, request)
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(signature)
+}
+
+// serveAgent answers one agent request.
+func serveAgent(conn net.Conn, keys map[string]crypto.Signer, spkis map[string][]byte) {
+	defer conn.Close()
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) == 1 && fields[0] == "KEYS":
+		for fingerprint, spki := range spkis {
+			fmt.Fprintln(conn, fingerprint, base64.StdEncoding.EncodeToString(spki))
+		}
+		fmt.Fprintln(conn, "OK")
+	case len(fields) == 5 && fields[0] == "SIGN":
+		key, ok := keys[fields[1]]
+		if !ok {
+			fmt.Fprintln(conn, "ERR no such key")
+			return
+		}
+		hash, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			fmt.Fprintln(conn, "ERR invalid hash")
+			return
+		}
+		var opts crypto.SignerOpts = crypto.Hash(hash)
+		if fields[3] != "-" {
+			salt, err := strconv.Atoi(fields[3])
+			if err != nil {
+				fmt.Fprintln(conn, "ERR invalid salt length")
+				return
+			}
+			opts = &rsa.PSSOptions{SaltLength: salt, Hash: crypto.Hash(hash)}
+		}
+		digest, err := base64.StdEncoding.DecodeString(fields[4])
+		if err != nil {
+			fmt.Fprintln(conn, "ERR invalid digest")
+			return
+		}
+		signature, err := key.Sign(rand.Reader, digest, opts)
+		if err != nil {
+			fmt.Fprintln(conn, "ERR", err)
+			return
+		}
+		fmt.Fprintln(conn, "OK", base64.StdEncoding.EncodeToString(signature))
+	default:
+		fmt.Fprintln(conn, "ERR unknown request")
+	}
+}
+
+// agentCommand implements "ircs agent".
+func agentCommand(args []string) {
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	socket := fs.String("sock", "", "Unix socket to listen on.")
+	keyPaths := fs.String("key", "", "Private key files or pkcs11: URIs. (comma-separated)")
+	pwd := fs.String("pwd", "", "Password of the private keys.")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage of ircs agent:")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *socket == "" || *keyPaths == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	keys := make(map[string]crypto.Signer)
+	spkis := make(map[string][]byte)
+	for _, path := range strings.Split(*keyPaths, ",") {
+		key, err := loadPrivateKey(strings.TrimSpace(path), []byte(*pwd))
+		if err != nil {
+			log.Fatal(err)
+		}
+		spki, err := x509.MarshalPKIXPublicKey(key.Public())
+		if err != nil {
+			log.Fatal(err)
+		}
+		fingerprint := spkiFingerprint(spki)
+		keys[fingerprint], spkis[fingerprint] = key, spki
+		name, _, _ := strings.Cut(path, "?")
+		log.Printf("%s: %s %s", name, describePublicKey(key.Public()), fingerprint)
+	}
+
+	listener, err := listenPrivate(*socket)
+	if err != nil {
+		log.Fatal(err)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		listener.Close()
+		os.Remove(*socket)
+		os.Exit(0)
+	}()
+
+	log.Println("Agent listening on", *socket)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go serveAgent(conn, keys, spkis)
+	}
+}
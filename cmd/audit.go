@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pedroalbanese/gogost/gost3410"
+	"github.com/pedroalbanese/gogost/gost34112012256"
+	"github.com/pedroalbanese/gogost/gost34112012512"
+)
+
+// auditRecord is one line of the audit log. Each record's hash covers the
+// record itself and, through prev, every record before it. Chat content is
+// never recorded.
+type auditRecord struct {
+	Seq    uint64            `json:"seq"`
+	Time   string            `json:"time"`
+	Event  string            `json:"event"`
+	Fields map[string]string `json:"fields"`
+	Prev   string            `json:"prev"`
+	Hash   string            `json:"hash,omitempty"`
+	Sig    string            `json:"sig,omitempty"`
+}
+
+// auditLog appends hash-chained records to the audit stream.
+type auditLog struct {
+	mu   sync.Mutex
+	out  io.Writer
+	seq  uint64
+	prev string
+	sign bool
+}
+
+var audit = &auditLog{out: os.Stderr}
+
+// openAuditLog appends the audit stream to the given file, continuing the
+// hash chain of the records already in it. With sign, the server key must
+// be able to sign records.
+func openAuditLog(path string, sign bool) error {
+	if sign {
+		if _, err := signAuditHash(currentServerKey(), ""); err != nil {
+			return fmt.Errorf("cannot sign audit records: %v", err)
+		}
+	}
+
+	var last auditRecord
+	if data, err := ioutil.ReadFile(path); err == nil {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			if err := json.Unmarshal(scanner.Bytes(), &last); err != nil {
+				return fmt.Errorf("%s: unreadable audit record after seq %d", path, last.Seq)
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	audit.mu.Lock()
+	defer audit.mu.Unlock()
+
+	audit.out = file
+	audit.seq = last.Seq
+	audit.prev = last.Hash
+	audit.sign = sign
+	return nil
+}
+
+// recordHash computes the chain hash of a record, ignoring its hash and
+// signature.
+func recordHash(record auditRecord) string {
+	record.Hash, record.Sig = "", ""
+	data, _ := json.Marshal(record)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// write appends an event with key/value pair fields to the audit log.
+func (a *auditLog) write(event string, fields ...string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	record := auditRecord{
+		Seq:    a.seq + 1,
+		Time:   time.Now().UTC().Format(time.RFC3339Nano),
+		Event:  event,
+		Fields: make(map[string]string),
+		Prev:   a.prev,
+	}
+	for i := 0; i+1 < len(fields); i += 2 {
+		record.Fields[fields[i]] = fields[i+1]
+	}
+	record.Hash = recordHash(record)
+
+	if a.sign {
+		// An unsigned record would break the signed trail, so stop instead
+		sig, err := signAuditHash(currentServerKey(), record.Hash)
+		if err != nil {
+			logError("cannot sign audit record, stopping", "seq", record.Seq, "error", err)
+			os.Exit(1)
+		}
+		record.Sig = base64.StdEncoding.EncodeToString(sig)
+	}
+
+	line, _ := json.Marshal(record)
+	if _, err := a.out.Write(append(line, '\n')); err != nil {
+		logError("cannot write audit record", "seq", record.Seq, "error", err)
+		return
+	}
+	a.seq = record.Seq
+	a.prev = record.Hash
+}
+
+// auditSigning reports whether audit records are signed.
+func auditSigning() bool {
+	audit.mu.Lock()
+	defer audit.mu.Unlock()
+
+	return audit.sign
+}
+
+// signAuditHash signs a record hash with a server private key: Ed25519
+// signs the hash itself, GOST R 34.10-2012 its Streebog digest and other
+// keys its SHA-256 digest.
+func signAuditHash(key crypto.PrivateKey, hash string) ([]byte, error) {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("server key cannot sign")
+	}
+	switch pub := signer.Public().(type) {
+	case ed25519.PublicKey:
+		return signer.Sign(rand.Reader, []byte(hash), crypto.Hash(0))
+	case *gost3410.PublicKey:
+		return signer.Sign(rand.Reader, streebogDigest(pub, hash), crypto.Hash(0))
+	case *ecdsa.PublicKey, *rsa.PublicKey:
+		digest := sha256.Sum256([]byte(hash))
+		return signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	return nil, errors.New("unsupported public key type")
+}
+
+// streebogDigest hashes a record hash with the Streebog function matching
+// the size of a GOST key.
+func streebogDigest(pub *gost3410.PublicKey, hash string) []byte {
+	h := gost34112012256.New()
+	if pub.C.PointSize() == 64 {
+		h = gost34112012512.New()
+	}
+	h.Write([]byte(hash))
+	return h.Sum(nil)
+}
+
+// checkAuditSignature verifies a record signature against a certificate.
+func checkAuditSignature(cert *x509.Certificate, hash string, sig []byte) error {
+	switch pub := cert.PublicKey.(type) {
+	case ed25519.PublicKey:
+		return cert.CheckSignature(x509.PureEd25519, []byte(hash), sig)
+	case *ecdsa.PublicKey:
+		return cert.CheckSignature(x509.ECDSAWithSHA256, []byte(hash), sig)
+	case *rsa.PublicKey:
+		return cert.CheckSignature(x509.SHA256WithRSA, []byte(hash), sig)
+	case *gost3410.PublicKey:
+		valid, err := pub.VerifyDigest(streebogDigest(pub, hash), sig)
+		if err == nil && !valid {
+			err = errors.New("GOST R 34.10-2012 verification failure")
+		}
+		return err
+	}
+	return errors.New("unsupported public key type")
+}
+
+// auditOper records an operator action.
+func auditOper(actor, action string, fields ...string) {
+	audit.write("oper", append([]string{"actor", actor, "action", action}, fields...)...)
+}
+
+// auditRoom records a room owner's action in their own room.
+func auditRoom(actor, action string, fields ...string) {
+	audit.write("room", append([]string{"actor", actor, "action", action}, fields...)...)
+}
+
+// auditAuth records the outcome of a client authentication.
+func auditAuth(event string, cert *x509.Certificate, fields ...string) {
+	if cert != nil {
+		fields = append(fields, "subject", cert.Subject.String(), "serial", fmt.Sprintf("%X", cert.SerialNumber))
+	}
+	audit.write(event, fields...)
+}
+
+// auditVerify checks the hash chain, and optionally the signatures, of an
+// audit log file.
+func auditVerify(args []string) {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	certPath := fs.String("cert", "", "Server certificate to verify record signatures with.")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage of ircs audit: [-cert server.pem] <audit log>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var cert *x509.Certificate
+	if *certPath != "" {
+		certPEM, err := ioutil.ReadFile(*certPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		block, _ := pem.Decode(certPEM)
+		if block == nil {
+			log.Fatal("no certificate found in " + *certPath)
+		}
+		if cert, err = x509.ParseCertificate(block.Bytes); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	file, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	n, err := verifyAuditLog(file, cert)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "FAIL: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("OK: %d records verified\n", n)
+}
+
+// verifyAuditLog walks an audit log and returns the number of records, or
+// an error naming the first line that was modified, removed or reordered.
+func verifyAuditLog(r io.Reader, cert *x509.Certificate) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var prev auditRecord
+	line := 0
+	for scanner.Scan() {
+		line++
+		var record auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return line - 1, fmt.Errorf("line %d: malformed record", line)
+		}
+		if line > 1 && record.Seq != prev.Seq+1 {
+			return line - 1, fmt.Errorf("line %d: sequence %d follows %d", line, record.Seq, prev.Seq)
+		}
+		if record.Prev != prev.Hash {
+			return line - 1, fmt.Errorf("line %d: chain broken, previous hash does not match", line)
+		}
+		if recordHash(record) != record.Hash {
+			return line - 1, fmt.Errorf("line %d: record hash does not match its content", line)
+		}
+		if cert != nil {
+			sig, err := base64.StdEncoding.DecodeString(record.Sig)
+			if err != nil || record.Sig == "" {
+				return line - 1, fmt.Errorf("line %d: missing or malformed signature", line)
+			}
+			if err := checkAuditSignature(cert, record.Hash, sig); err != nil {
+				return line - 1, fmt.Errorf("line %d: bad signature: %v", line, err)
+			}
+		}
+		prev = record
+	}
+	return line, scanner.Err()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pedroalbanese/gogost/gost3410"
+)
+
+func testSigners(t *testing.T) map[string]crypto.Signer {
+	t.Helper()
+	_, ed, _ := ed25519.GenerateKey(rand.Reader)
+	ec, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	gost256, err := gost3410.GenPrivateKey(gost3410.CurveIdtc26gost34102012256paramSetA(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gost512, err := gost3410.GenPrivateKey(gost3410.CurveIdtc26gost34102012512paramSetA(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]crypto.Signer{
+		"ed25519": ed, "ecdsa": ec, "rsa": rsaKey, "gost2012-256": gost256, "gost2012-512": gost512,
+	}
+}
+
+func TestAuditSignatureRoundTrip(t *testing.T) {
+	for name, key := range testSigners(t) {
+		cert := &x509.Certificate{PublicKey: key.Public()}
+		hash := recordHash(auditRecord{Seq: 1, Event: "admit"})
+
+		sig, err := signAuditHash(key, hash)
+		if err != nil {
+			t.Errorf("%s: sign: %v", name, err)
+			continue
+		}
+		if err := checkAuditSignature(cert, hash, sig); err != nil {
+			t.Errorf("%s: verify: %v", name, err)
+		}
+		if err := checkAuditSignature(cert, recordHash(auditRecord{Seq: 2}), sig); err == nil {
+			t.Errorf("%s: signature verified for another record", name)
+		}
+	}
+}
+
+// setAuditOutput points the audit stream at a buffer for a test.
+func setAuditOutput(t *testing.T, key crypto.Signer, sign bool) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	pkiMu.Lock()
+	savedKey := serverKeyPair
+	serverKeyPair = &tls.Certificate{PrivateKey: key}
+	pkiMu.Unlock()
+
+	audit.mu.Lock()
+	savedOut, savedSeq, savedPrev, savedSign := audit.out, audit.seq, audit.prev, audit.sign
+	audit.out, audit.seq, audit.prev, audit.sign = &buf, 0, "", sign
+	audit.mu.Unlock()
+
+	t.Cleanup(func() {
+		pkiMu.Lock()
+		serverKeyPair = savedKey
+		pkiMu.Unlock()
+		audit.mu.Lock()
+		audit.out, audit.seq, audit.prev, audit.sign = savedOut, savedSeq, savedPrev, savedSign
+		audit.mu.Unlock()
+	})
+	return &buf
+}
+
+func TestVerifySignedAuditLog(t *testing.T) {
+	for name, key := range testSigners(t) {
+		t.Run(name, func(t *testing.T) {
+			buf := setAuditOutput(t, key, true)
+			auditOper("@admin", "login", "keyid", "ABCD")
+			auditOper("@admin", "kill", "target", "@mallory")
+			auditOper("@admin", "unban", "keyid", "ABCD")
+			log := buf.String()
+
+			cert := &x509.Certificate{PublicKey: key.Public()}
+			if n, err := verifyAuditLog(strings.NewReader(log), cert); err != nil || n != 3 {
+				t.Fatalf("verified %d records: %v", n, err)
+			}
+
+			tampered := strings.Replace(log, "@mallory", "@alice", 1)
+			if _, err := verifyAuditLog(strings.NewReader(tampered), nil); err == nil || !strings.Contains(err.Error(), "line 2") {
+				t.Errorf("modified record not found: %v", err)
+			}
+			lines := strings.SplitAfter(log, "\n")
+			removed := lines[0] + lines[2]
+			if _, err := verifyAuditLog(strings.NewReader(removed), nil); err == nil {
+				t.Error("removed record not found")
+			}
+			unsigned := strings.Replace(log, `"sig":"`, `"nosig":"`, 1)
+			if _, err := verifyAuditLog(strings.NewReader(unsigned), cert); err == nil {
+				t.Error("unsigned record accepted")
+			}
+		})
+	}
+}
+
+// notSigner is a private key that cannot sign.
+type notSigner struct{}
+
+func TestAuditSigningNeedsSigningKey(t *testing.T) {
+	setAuditOutput(t, nil, false)
+	pkiMu.Lock()
+	serverKeyPair = &tls.Certificate{PrivateKey: notSigner{}}
+	pkiMu.Unlock()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if err := openAuditLog(path, true); err == nil {
+		t.Error("signed audit log opened with a key that cannot sign")
+	}
+	if err := openAuditLog(path, false); err != nil {
+		t.Errorf("unsigned audit log: %v", err)
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certAuthority is a CA kept in a directory holding ca.pem, ca.key, the
+// index.txt of issued certificates and crl.pem.
+type certAuthority struct {
+	mu   sync.Mutex
+	dir  string
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// indexEntry is one line of index.txt, in the OpenSSL layout:
+// status (V or R), expiry, revocation time, serial, file name and subject.
+type indexEntry struct {
+	status    string
+	expiry    time.Time
+	revokedAt time.Time
+	serial    string
+	subject   string
+}
+
+const indexTimeFormat = "060102150405Z"
+
+var errNotIssued = errors.New("serial was not issued by this CA")
+
+// loadCA opens the CA in dir.
+func loadCA(dir string, password []byte) (*certAuthority, error) {
+	certPEM, err := ioutil.ReadFile(filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, errors.New("no certificate found in " + filepath.Join(dir, "ca.pem"))
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, err := loadPrivateKey(filepath.Join(dir, "ca.key"), password)
+	if err != nil {
+		return nil, err
+	}
+	return &certAuthority{dir: dir, cert: cert, key: key}, nil
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// sign issues a client certificate, or a server certificate if server is
+// set, for a CSR and records it in the index.
+func (ca *certAuthority) sign(csr *x509.CertificateRequest, days int, server bool) (*x509.Certificate, error) {
+	if err := csr.CheckSignature(); err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:   serial,
+		RawSubject:     csr.RawSubject,
+		EmailAddresses: csr.EmailAddresses,
+		DNSNames:       csr.DNSNames,
+		IPAddresses:    csr.IPAddresses,
+		NotBefore:      time.Now().Add(-5 * time.Minute),
+		NotAfter:       time.Now().AddDate(0, 0, days),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if _, ok := csr.PublicKey.(*rsa.PublicKey); ok {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	if server {
+		template.ExtKeyUsage = append(template.ExtKeyUsage, x509.ExtKeyUsageServerAuth)
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, csr.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := os.OpenFile(filepath.Join(ca.dir, "index.txt"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer index.Close()
+	entry := indexEntry{status: "V", expiry: cert.NotAfter, serial: fmt.Sprintf("%X", cert.SerialNumber), subject: cert.Subject.String()}
+	if _, err := fmt.Fprintln(index, entry); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+func (e indexEntry) String() string {
+	revokedAt := ""
+	if e.status == "R" {
+		revokedAt = e.revokedAt.UTC().Format(indexTimeFormat)
+	}
+	return strings.Join([]string{e.status, e.expiry.UTC().Format(indexTimeFormat), revokedAt, e.serial, "unknown", e.subject}, "\t")
+}
+
+// index reads index.txt.
+func (ca *certAuthority) index() ([]indexEntry, error) {
+	path := filepath.Join(ca.dir, "index.txt")
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []indexEntry
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if scanner.Text() == "" {
+			continue
+		}
+		fields := strings.SplitN(scanner.Text(), "\t", 6)
+		if len(fields) != 6 || (fields[0] != "V" && fields[0] != "R") {
+			return nil, fmt.Errorf("%s:%d: malformed index entry", path, line)
+		}
+		entry := indexEntry{status: fields[0], serial: fields[3], subject: fields[5]}
+		if entry.expiry, err = time.Parse(indexTimeFormat, fields[1]); err != nil {
+			return nil, fmt.Errorf("%s:%d: malformed expiry time", path, line)
+		}
+		if entry.status == "R" {
+			if entry.revokedAt, err = time.Parse(indexTimeFormat, fields[2]); err != nil {
+				return nil, fmt.Errorf("%s:%d: malformed revocation time", path, line)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// revoke marks a serial number revoked in the index and rewrites the CRL.
+func (ca *certAuthority) revoke(serial *big.Int, crlDays int) error {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	entries, err := ca.index()
+	if err != nil {
+		return err
+	}
+	found := false
+	var lines []string
+	for _, entry := range entries {
+		if entry.serial == fmt.Sprintf("%X", serial) {
+			if entry.status == "R" {
+				return fmt.Errorf("serial %X is already revoked", serial)
+			}
+			entry.status, entry.revokedAt = "R", time.Now()
+			found = true
+		}
+		lines = append(lines, entry.String()+"\n")
+	}
+	if !found {
+		return fmt.Errorf("%X: %w", serial, errNotIssued)
+	}
+	if err := replaceFile(filepath.Join(ca.dir, "index.txt"), []byte(strings.Join(lines, "")), 0600); err != nil {
+		return err
+	}
+	return ca.writeCRL(crlDays)
+}
+
+// writeCRL signs a new crl.pem listing the revoked certificates. The
+// caller holds ca.mu.
+func (ca *certAuthority) writeCRL(days int) error {
+	entries, err := ca.index()
+	if err != nil {
+		return err
+	}
+	var revoked []pkix.RevokedCertificate
+	for _, entry := range entries {
+		if entry.status != "R" {
+			continue
+		}
+		serial, ok := new(big.Int).SetString(entry.serial, 16)
+		if !ok {
+			return errors.New("malformed serial in index: " + entry.serial)
+		}
+		revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: serial, RevocationTime: entry.revokedAt})
+	}
+
+	now := time.Now()
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		RevokedCertificates: revoked,
+		Number:              big.NewInt(now.Unix()),
+		ThisUpdate:          now,
+		NextUpdate:          now.AddDate(0, 0, days),
+	}, ca.cert, ca.key)
+	if err != nil {
+		return err
+	}
+	return writePEM(filepath.Join(ca.dir, "crl.pem"), &pem.Block{Type: "X509 CRL", Bytes: der}, 0644)
+}
+
+// initCA creates a self-signed CA in dir.
+func initCA(dir string, key crypto.Signer, subject pkix.Name, days int, password, cipherName, kdf string) error {
+	if _, err := os.Stat(filepath.Join(dir, "ca.key")); err == nil {
+		return errors.New(filepath.Join(dir, "ca.key") + " already exists")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               subject,
+		NotBefore:             time.Now().Add(-5 * time.Minute),
+		NotAfter:              time.Now().AddDate(0, 0, days),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+
+	block, err := encodePrivateKey(key, password, cipherName, kdf)
+	if err != nil {
+		return err
+	}
+	if err := writePEM(filepath.Join(dir, "ca.key"), block, 0600); err != nil {
+		return err
+	}
+	if err := writePEM(filepath.Join(dir, "ca.pem"), &pem.Block{Type: "CERTIFICATE", Bytes: der}, 0644); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "index.txt"), nil, 0600); err != nil {
+		return err
+	}
+	ca := &certAuthority{dir: dir, cert: cert, key: key}
+	return ca.writeCRL(30)
+}
+
+// parseCSR decodes a PEM or DER certificate signing request.
+func parseCSR(data []byte) (*x509.CertificateRequest, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	return x509.ParseCertificateRequest(data)
+}
+
+// caCommand implements "ircs ca init|sign|revoke|crl|list".
+func caCommand(args []string) {
+	usage := "Usage of ircs ca: <init|sign|revoke|crl|list> [-dir ca] [flags]"
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("ca "+args[0], flag.ExitOnError)
+	dir := fs.String("dir", "ca", "CA directory.")
+	pwd := fs.String("pwd", "", "Password of the CA private key.")
+	crlDays := fs.Int("crldays", 30, "Days until the next CRL update.")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+
+	switch args[0] {
+	case "init":
+		alg := fs.String("alg", "ecdsa", "Key algorithm: <"+strings.Join(keyAlgorithms, "|")+">")
+		bits := fs.Int("bits", 3072, "RSA key size.")
+		curve := fs.String("curve", "", "ECDSA curve <P-256|P-384|P-521> or GOST parameter set <A|B|C|D>.")
+		keyPath := fs.String("key", "", "Existing private key to use instead of generating one.")
+		subject := fs.String("subject", "", "Subject DN, e.g. \"CN=Chat CA,O=Example\".")
+		cipherName := fs.String("cipher", "AES-256-CBC", "Private key encryption cipher.")
+		kdf := fs.String("kdf", "pbkdf2", "Private key encryption: <"+strings.Join(keyKDFs, "|")+">")
+		days := fs.Int("days", 3650, "Validity in days.")
+		fs.Parse(args[1:])
+		if *subject == "" {
+			fs.Usage()
+			os.Exit(2)
+		}
+		name, err := parseSubject(*subject)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var key crypto.Signer
+		if *keyPath != "" {
+			key, err = loadPrivateKey(*keyPath, []byte(*pwd))
+		} else {
+			key, err = generateKey(*alg, *bits, *curve)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := initCA(*dir, key, name, *days, *pwd, *cipherName, *kdf); err != nil {
+			log.Fatal(err)
+		}
+	case "sign":
+		csrPath := fs.String("csr", "", "Certificate signing request file.")
+		out := fs.String("out", "", "Certificate output file. (default stdout)")
+		server := fs.Bool("server", false, "Issue a server certificate.")
+		days := fs.Int("days", 365, "Validity in days.")
+		fs.Parse(args[1:])
+		if *csrPath == "" {
+			fs.Usage()
+			os.Exit(2)
+		}
+		ca, err := loadCA(*dir, []byte(*pwd))
+		if err != nil {
+			log.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(*csrPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		csr, err := parseCSR(data)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cert, err := ca.sign(csr, *days, *server)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := writePEM(*out, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}, 0644); err != nil {
+			log.Fatal(err)
+		}
+	case "revoke":
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		serial, ok := new(big.Int).SetString(strings.TrimPrefix(strings.ToLower(fs.Arg(0)), "0x"), 16)
+		if !ok {
+			log.Fatal("invalid serial number: " + fs.Arg(0))
+		}
+		ca, err := loadCA(*dir, []byte(*pwd))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := ca.revoke(serial, *crlDays); err != nil {
+			log.Fatal(err)
+		}
+	case "crl":
+		fs.Parse(args[1:])
+		ca, err := loadCA(*dir, []byte(*pwd))
+		if err != nil {
+			log.Fatal(err)
+		}
+		ca.mu.Lock()
+		err = ca.writeCRL(*crlDays)
+		ca.mu.Unlock()
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "list":
+		fs.Parse(args[1:])
+		ca := &certAuthority{dir: *dir}
+		entries, err := ca.index()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, entry := range entries {
+			fmt.Println(entry)
+		}
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bufio"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// configKeys maps the "<section>.<key>" settings of the configuration file
+// to the flags they set.
+var configKeys = map[string]string{
+	"server.mode":       "mode",
+	"server.listen":     "listen",
+	"client.server":     "ipport",
+	"client.contacts":   "contacts",
+	"tls.cert":          "cert",
+	"tls.key":           "key",
+	"tls.key_password":  "pwd",
+	"tls.profile":       "tlsprofile",
+	"tls.min_version":   "tlsmin",
+	"tls.max_version":   "tlsmax",
+	"tls.ciphers":       "tlsciphers",
+	"tls.curves":        "tlscurves",
+	"tls.sigalgs":       "tlssigalgs",
+	"pki.keyid":         "keyid",
+	"pki.identity":      "identity",
+	"pki.strict":        "strict",
+	"pki.client_ca":     "clientca",
+	"revocation.crl":    "crl",
+	"ca.dir":            "cadir",
+	"ca.key_password":   "capwd",
+	"ca.tokens":         "enrolltoken",
+	"limits.sessions":   "sessions",
+	"limits.ratelimit":  "ratelimit",
+	"rooms.create":      "roomcreate",
+	"rooms.permanent":   "rooms",
+	"rooms.max_members": "roomsize",
+	"users.nick":        "nick",
+	"users.nickreg":     "nickreg",
+	"users.opers":       "opers",
+	"logging.level":     "loglevel",
+	"logging.format":    "logformat",
+	"logging.output":    "logout",
+	"logging.privacy":   "logprivacy",
+	"audit.file":        "audit",
+	"audit.sign":        "auditsign",
+	"admin.socket":      "admin",
+	"admin.metrics":     "metrics",
+}
+
+// configOrigin records where each flag set from the configuration file or
+// the environment came from, for error messages.
+var configOrigin = make(map[string]string)
+
+type configSetting struct {
+	flag   string
+	value  string
+	origin string
+}
+
+// envName returns the environment variable overriding a flag.
+func envName(flagName string) string {
+	return "IRCS_" + strings.ToUpper(flagName)
+}
+
+// applyConfig sets the flags that were not given on the command line from
+// the -config file, then from IRCS_<FLAG> environment variables. Command
+// line flags take precedence over the environment, which takes precedence
+// over the file.
+func applyConfig() error {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	if value, ok := os.LookupEnv(envName("config")); ok && !explicit["config"] {
+		*configFile = value
+	}
+	if *configFile != "" {
+		settings, err := parseConfigFile(*configFile)
+		if err != nil {
+			return err
+		}
+		for _, s := range settings {
+			if explicit[s.flag] {
+				continue
+			}
+			if err := flag.Set(s.flag, s.value); err != nil {
+				return fmt.Errorf("%s: invalid value %q", s.origin, s.value)
+			}
+			configOrigin[s.flag] = s.origin
+		}
+	}
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || explicit[f.Name] || f.Name == "config" || err != nil {
+			return
+		}
+		if flag.Set(f.Name, value) != nil {
+			err = fmt.Errorf("%s: invalid value %q", envName(f.Name), value)
+			return
+		}
+		configOrigin[f.Name] = envName(f.Name)
+	})
+	return err
+}
+
+// parseConfigFile reads a TOML configuration file. Only the subset needed
+// for flat settings is supported: [section] headers, key = value pairs
+// with quoted strings, integers, booleans and arrays of those, and
+// comments.
+func parseConfigFile(path string) ([]configSetting, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	sections := make(map[string]bool)
+	for name := range configKeys {
+		section, _, _ := strings.Cut(name, ".")
+		sections[section] = true
+	}
+
+	var settings []configSetting
+	seen := make(map[string]int)
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := unquotedIndex(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+
+		if strings.HasPrefix(text, "[") {
+			if !strings.HasSuffix(text, "]") {
+				return nil, fmt.Errorf("%s:%d: malformed section header", path, line)
+			}
+			section = strings.TrimSpace(text[1 : len(text)-1])
+			if !sections[section] {
+				return nil, fmt.Errorf("%s:%d: unknown section [%s]", path, line, section)
+			}
+			continue
+		}
+
+		key, raw, ok := strings.Cut(text, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected \"key = value\"", path, line)
+		}
+		key = strings.TrimSpace(key)
+		if section == "" {
+			return nil, fmt.Errorf("%s:%d: %s is outside a section", path, line, key)
+		}
+		name := section + "." + key
+		flagName, ok := configKeys[name]
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: unknown setting %s", path, line, name)
+		}
+		if first, dup := seen[name]; dup {
+			return nil, fmt.Errorf("%s:%d: %s is already set on line %d", path, line, name, first)
+		}
+		seen[name] = line
+
+		value, err := parseConfigValue(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %v", path, line, name, err)
+		}
+		settings = append(settings, configSetting{
+			flag:   flagName,
+			value:  value,
+			origin: fmt.Sprintf("%s:%d: %s", path, line, name),
+		})
+	}
+	return settings, scanner.Err()
+}
+
+// parseConfigValue converts a TOML value to a flag value. Arrays become
+// comma-separated lists.
+func parseConfigValue(raw string) (string, error) {
+	if strings.HasPrefix(raw, "[") {
+		if !strings.HasSuffix(raw, "]") {
+			return "", errors.New("unterminated array")
+		}
+		rest := strings.TrimSpace(raw[1 : len(raw)-1])
+		var values []string
+		for rest != "" {
+			item := rest
+			if i := unquotedIndex(rest, ','); i >= 0 {
+				item, rest = rest[:i], strings.TrimSpace(rest[i+1:])
+			} else {
+				rest = ""
+			}
+			value, err := parseConfigValue(strings.TrimSpace(item))
+			if err != nil {
+				return "", err
+			}
+			values = append(values, value)
+		}
+		return strings.Join(values, ","), nil
+	}
+
+	switch {
+	case raw == "":
+		return "", errors.New("missing value")
+	case strings.HasPrefix(raw, `"`):
+		value, err := strconv.Unquote(raw)
+		if err != nil {
+			return "", errors.New("malformed string " + raw)
+		}
+		return value, nil
+	case strings.HasPrefix(raw, "'"):
+		if len(raw) < 2 || !strings.HasSuffix(raw, "'") {
+			return "", errors.New("malformed string " + raw)
+		}
+		return raw[1 : len(raw)-1], nil
+	case raw == "true" || raw == "false":
+		return raw, nil
+	}
+	if _, err := strconv.ParseInt(strings.ReplaceAll(raw, "_", ""), 10, 64); err == nil {
+		return strings.ReplaceAll(raw, "_", ""), nil
+	}
+	return "", fmt.Errorf("invalid value %s (expected a quoted string, integer, boolean or array)", raw)
+}
+
+// unquotedIndex returns the index of the first c in s that is not inside a
+// quoted string, or -1.
+func unquotedIndex(s string, c byte) int {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quote == '"' && s[i] == '\\':
+			i++
+		case quote != 0:
+			if s[i] == quote {
+				quote = 0
+			}
+		case s[i] == '"' || s[i] == '\'':
+			quote = s[i]
+		case s[i] == c:
+			return i
+		}
+	}
+	return -1
+}
+
+// configError attributes a validation error to the setting it came from.
+func configError(flagName string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if origin, ok := configOrigin[flagName]; ok {
+		return fmt.Errorf("%s: %v", origin, err)
+	}
+	return fmt.Errorf("-%s: %v", flagName, err)
+}
+
+// checkConfig validates the effective settings, loading the certificates,
+// CRL and nickname registry they name.
+func checkConfig() error {
+	if *mode != "server" && *mode != "client" {
+		return configError("mode", errors.New("unknown mode: "+*mode))
+	}
+	if *certFile == "" || *keyFile == "" {
+		return errors.New("both cert and key must be set")
+	}
+	policy, err := newTLSPolicy()
+	if err != nil {
+		return err
+	}
+	if *mode == "client" {
+		if _, _, err := net.SplitHostPort(*serverAddr); err != nil {
+			return configError("ipport", err)
+		}
+		cert, err := loadKeyPair(*certFile, *keyFile, []byte(*keyPass))
+		if err != nil {
+			return configError("cert", err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err == nil {
+			err = policy.checkLocalCertificate(leaf)
+		}
+		return configError("cert", err)
+	}
+
+	checks := []struct {
+		flag  string
+		check func() error
+	}{
+		{"listen", func() error {
+			_, _, err := net.SplitHostPort(*listenAddr)
+			return err
+		}},
+		{"cadir", func() error {
+			if *caDir == "" {
+				return nil
+			}
+			return loadEnrollment()
+		}},
+		{"cert", loadServerPKI},
+		{"cert", func() error { return policy.checkLocalCertificate(currentServerCert()) }},
+		{"keyid", func() error { return checkKeyIDMethod(*keyIDAlg) }},
+		{"identity", func() error { return checkIdentitySpec(*identMap) }},
+		{"sessions", func() error {
+			_, _, err := parseSessionPolicy(*sessionPol)
+			return err
+		}},
+		{"ratelimit", func() error {
+			if *rateLimit < 0 {
+				return errors.New("rate limit cannot be negative")
+			}
+			return nil
+		}},
+		{"roomcreate", func() error {
+			switch *roomCreate {
+			case "any", "opers":
+				return nil
+			}
+			return errors.New("unknown room creation policy: " + *roomCreate)
+		}},
+		{"roomsize", func() error {
+			if *roomSize < 0 {
+				return errors.New("room size cannot be negative")
+			}
+			return nil
+		}},
+		{"rooms", func() error {
+			for _, name := range permanentRooms() {
+				if strings.ContainsAny(name, " \t") {
+					return errors.New("invalid room name: " + name)
+				}
+			}
+			return nil
+		}},
+		{"nick", func() error {
+			switch *nickPolicy {
+			case "off", "free", "registry":
+				return nil
+			}
+			return errors.New("unknown nick policy: " + *nickPolicy)
+		}},
+		{"nickreg", func() error {
+			if *nickFile == "" {
+				return nil
+			}
+			_, err := loadNickRegistry(*nickFile)
+			return err
+		}},
+		{"loglevel", func() error {
+			_, err := parseLogLevel(*logLvl)
+			return err
+		}},
+		{"logformat", func() error { return checkLogFormat(*logFormat) }},
+		{"logprivacy", func() error { return checkLogPrivacy(*logPrivacy) }},
+		{"metrics", func() error {
+			if *metricAddr == "" {
+				return nil
+			}
+			_, _, err := net.SplitHostPort(*metricAddr)
+			return err
+		}},
+	}
+	for _, c := range checks {
+		if err := c.check(); err != nil {
+			return configError(c.flag, err)
+		}
+	}
+	return nil
+}
+
+// checkConfigCommand implements "ircs check-config": it validates the
+// flags, configuration file and environment without starting anything.
+func checkConfigCommand(args []string) {
+	flag.CommandLine.Parse(args)
+	if err := applyConfig(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := checkConfig(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println("configuration OK")
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pedroalbanese/color"
+)
+
+// The client remembers the certificate key of every user it meets, keyed
+// by the identity the server maps from their certificate, in a store like
+// SSH's known_hosts. Users are trusted on first use until verified by
+// comparing safety numbers out of band, and a known identity showing up
+// with another key is reported loudly.
+
+// Iterations of the safety number hash, as in Signal
+const safetyIterations = 5200
+
+type contact struct {
+	identity    string
+	fingerprint string // SHA-256 of the SPKI, upper-case hex
+	verified    bool
+	since       time.Time
+}
+
+// contactStore is the client's contact file and the lookups of the current
+// session.
+type contactStore struct {
+	mu       sync.Mutex
+	path     string
+	self     string // our own key fingerprint
+	name     string // our own name, from a lookup of our key
+	contacts map[string]*contact
+	looked   map[string]bool   // names already looked up
+	pending  map[string]string // names looked up, with what to do with the reply
+	selfLook bool              // our own key was looked up
+	warned   map[string]bool   // identities already warned about
+}
+
+// keyOf answers "KEYOF <nick>" with the key fingerprint and identity of a
+// user, in a line the client handles itself; a bare "KEYOF" asks for our
+// own. An unknown nick gets a bare "KEY <nick>", so that lookups of users
+// who just left stay quiet. Only its first word is echoed, so that the
+// reply can never read as a key record.
+func keyOf(nick string, client *Client) string {
+	if client == nil {
+		if fields := strings.Fields(nick); len(fields) > 0 {
+			return "KEY " + fields[0] + "\n"
+		}
+		return "KEY\n"
+	}
+	sum := sha256.Sum256(client.clientCert.RawSubjectPublicKeyInfo)
+	return fmt.Sprintf("KEY %s %X %s\n", client.name(), sum[:], client.identity)
+}
+
+// contactsPath returns the -contacts file, by default next to the -cert
+// file.
+func contactsPath() string {
+	if *contactDB != "" {
+		return *contactDB
+	}
+	return strings.TrimSuffix(*certFile, filepath.Ext(*certFile)) + ".contacts"
+}
+
+// loadContacts reads a contact file. Each line holds a fingerprint, the
+// status ("verified" or "unverified"), the date it was first seen and the
+// identity.
+func loadContacts(path string, self []byte) (*contactStore, error) {
+	sum := sha256.Sum256(self)
+	store := &contactStore{
+		path:     path,
+		self:     fmt.Sprintf("%X", sum[:]),
+		contacts: make(map[string]*contact),
+		looked:   make(map[string]bool),
+		pending:  make(map[string]string),
+		warned:   make(map[string]bool),
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.SplitN(text, " ", 4)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("%s:%d: malformed contact", path, line)
+		}
+		since, err := time.Parse(time.RFC3339, fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		store.contacts[fields[3]] = &contact{
+			identity:    fields[3],
+			fingerprint: fields[0],
+			verified:    fields[1] == "verified",
+			since:       since,
+		}
+	}
+	return store, scanner.Err()
+}
+
+// save writes the contact file; the caller holds mu.
+func (s *contactStore) save() error {
+	identities := make([]string, 0, len(s.contacts))
+	for identity := range s.contacts {
+		identities = append(identities, identity)
+	}
+	sort.Strings(identities)
+
+	var b strings.Builder
+	b.WriteString("# fingerprint status first-seen identity\n")
+	for _, identity := range identities {
+		c := s.contacts[identity]
+		status := "unverified"
+		if c.verified {
+			status = "verified"
+		}
+		fmt.Fprintf(&b, "%s %s %s %s\n", c.fingerprint, status, c.since.UTC().Format(time.RFC3339), c.identity)
+	}
+	return os.WriteFile(s.path, []byte(b.String()), 0600)
+}
+
+// lookup returns the "KEYOF" request for a name seen in the chat, or ""
+// if it was already looked up in this session.
+func (s *contactStore) lookup(name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name = strings.ToLower(name)
+	if s.looked[name] {
+		return ""
+	}
+	s.looked[name] = true
+	if _, ok := s.pending[name]; !ok {
+		s.pending[name] = ""
+	}
+	return "KEYOF " + name
+}
+
+// lookupSelf returns the "KEYOF" request for our own key, whose reply
+// tells our name.
+func (s *contactStore) lookupSelf() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.selfLook = true
+	return "KEYOF"
+}
+
+// request looks a name up to show its safety number ("safety") or to mark
+// its key verified ("verify").
+func (s *contactStore) request(name, action string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name = "@" + strings.TrimPrefix(strings.ToLower(name), "@")
+	s.looked[name] = true
+	s.pending[name] = action
+	return "KEYOF " + name
+}
+
+// observe records the key of a user from a "KEY <name> <fingerprint>
+// <identity>" reply and returns what to tell the user. Only replies to our
+// own lookups are taken, so that no one can plant a key with a line of
+// their own.
+func (s *contactStore) observe(reply string) []string {
+	fields := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(reply, "KEY ")), " ", 3)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	action, requested := s.pending[strings.ToLower(fields[0])]
+	delete(s.pending, strings.ToLower(fields[0]))
+	if len(fields) != 3 {
+		if action != "" {
+			return []string{"No such user."}
+		}
+		return nil
+	}
+	name, fingerprint, identity := fields[0], fields[1], fields[2]
+	if fingerprint == s.self {
+		if requested || s.selfLook {
+			s.name, s.selfLook = name, false
+		}
+		return nil
+	}
+	if !requested {
+		return nil
+	}
+
+	var notes []string
+	known := s.contacts[identity]
+	switch {
+	case known == nil:
+		s.contacts[identity] = &contact{identity: identity, fingerprint: fingerprint, since: time.Now()}
+		if err := s.save(); err != nil {
+			notes = append(notes, "Error saving contacts: "+err.Error())
+		}
+		notes = append(notes, fmt.Sprintf("New contact %s (%s), key %s, not verified yet.", name, identity, fingerprint))
+	case known.fingerprint != fingerprint && action != "verify" && !s.warned[identity]:
+		s.warned[identity] = true
+		status := "unverified"
+		if known.verified {
+			status = "VERIFIED"
+		}
+		notes = append(notes,
+			fmt.Sprintf("WARNING: %s (%s) HAS A DIFFERENT CERTIFICATE KEY!", name, identity),
+			fmt.Sprintf("WARNING: known %s key %s since %s", status, known.fingerprint, known.since.Format("2006-01-02")),
+			fmt.Sprintf("WARNING: new key %s", fingerprint),
+			fmt.Sprintf("WARNING: someone may be impersonating them. Compare SAFETY %s out of band, then VERIFY %s to accept the new key.", name, name))
+	}
+
+	switch action {
+	case "safety":
+		notes = append(notes, fmt.Sprintf("Safety number with %s (%s):", name, identity))
+		notes = append(notes, formatSafetyNumber(safetyNumber(s.self, fingerprint)))
+		if known != nil && known.verified && known.fingerprint == fingerprint {
+			notes = append(notes, "This key is verified.")
+		}
+	case "verify":
+		s.contacts[identity] = &contact{identity: identity, fingerprint: fingerprint, verified: true, since: time.Now()}
+		if known != nil && known.fingerprint == fingerprint {
+			s.contacts[identity].since = known.since
+		}
+		delete(s.warned, identity)
+		if err := s.save(); err != nil {
+			notes = append(notes, "Error saving contacts: "+err.Error())
+		}
+		notes = append(notes, fmt.Sprintf("Marked the key of %s (%s) as verified: %s", name, identity, fingerprint))
+	}
+	return notes
+}
+
+// selfName returns our own name, once the server told it.
+func (s *contactStore) selfName() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.name
+}
+
+// list describes the contacts.
+func (s *contactStore) list() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var lines []string
+	for _, c := range s.contacts {
+		status := "unverified"
+		if c.verified {
+			status = "verified"
+		}
+		lines = append(lines, fmt.Sprintf("- %s: %s %s since %s", c.identity, c.fingerprint, status, c.since.Format("2006-01-02")))
+	}
+	sort.Strings(lines)
+	return append([]string{"Contacts (" + s.path + "):"}, lines...)
+}
+
+// safetyNumber combines two key fingerprints into 60 digits that both
+// users compute alike: 30 digits per key from an iterated SHA-512, the
+// lower half first.
+func safetyNumber(a, b string) string {
+	digits := func(fingerprint string) string {
+		key, _ := hex.DecodeString(fingerprint)
+		hash := append([]byte{0, 1}, key...)
+		for i := 0; i < safetyIterations; i++ {
+			sum := sha512.Sum512(append(hash, key...))
+			hash = sum[:]
+		}
+		var out string
+		for i := 0; i < 30; i += 5 {
+			chunk := binary.BigEndian.Uint64(append([]byte{0, 0, 0}, hash[i:i+5]...))
+			out += fmt.Sprintf("%05d", chunk%100000)
+		}
+		return out
+	}
+	x, y := digits(a), digits(b)
+	if x > y {
+		x, y = y, x
+	}
+	return x + y
+}
+
+// formatSafetyNumber splits a safety number into three lines of four
+// groups of five digits.
+func formatSafetyNumber(number string) string {
+	var out string
+	for i := 0; i < len(number); i += 5 {
+		switch {
+		case i == 0:
+		case i%20 == 0:
+			out += "\n"
+		default:
+			out += " "
+		}
+		out += number[i : i+5]
+	}
+	return out
+}
+
+// messageSender returns the "@name" a chat line is from or about, and the
+// new name of a nickname change notice.
+func messageSender(message string) []string {
+	message = strings.TrimSpace(message)
+	if strings.HasPrefix(message, "[") {
+		if i := strings.Index(message, "] "); i >= 0 {
+			message = message[i+2:]
+		}
+	}
+	fields := strings.Fields(message)
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "@") {
+		return nil
+	}
+	names := []string{strings.TrimSuffix(strings.TrimSuffix(fields[0], "#"), ":")}
+	if _, renamed, ok := parseRename(message); ok {
+		names = append(names, renamed)
+	}
+	return names
+}
+
+// parseRename parses an "@old is now known as @new." notice of the server.
+// Chat lines start with "@sender#", so no message text can pass for one.
+func parseRename(text string) (string, string, bool) {
+	fields := strings.Fields(text)
+	if len(fields) != 6 || strings.Join(fields[1:5], " ") != "is now known as" ||
+		!strings.HasPrefix(fields[0], "@") || strings.HasSuffix(fields[0], "#") ||
+		!strings.HasPrefix(fields[5], "@") || !strings.HasSuffix(fields[5], ".") {
+		return "", "", false
+	}
+	return fields[0], strings.TrimSuffix(fields[5], "."), true
+}
+
+// printWarning prints a contact warning in red.
+func printWarning(line string) {
+	color.New(color.FgHiRed, color.Bold).Println(line)
+}
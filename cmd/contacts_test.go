@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMessageSenderIgnoresMessageText(t *testing.T) {
+	for line, want := range map[string][]string{
+		"[#room] @bob# hello":                               {"@bob"},
+		"[#room] @bob is now known as @robert.":             {"@bob", "@robert"},
+		"[#room] @mallory# x is now known as @alice AB bob": {"@mallory"},
+		"[#room] @mallory# @x is now known as @alice.":      {"@mallory"},
+		"*** Announcement from @op: hi":                     nil,
+	} {
+		if got := messageSender(line); !reflect.DeepEqual(got, want) {
+			t.Errorf("messageSender(%q) = %q, want %q", line, got, want)
+		}
+	}
+}
+
+func TestKeyOfUnknownNick(t *testing.T) {
+	for _, nick := range []string{"@alice ABCD bob", "@alice\tABCD bob", "  "} {
+		reply := keyOf(nick, nil)
+		if fields := strings.Fields(strings.TrimPrefix(reply, "KEY")); len(fields) > 1 {
+			t.Errorf("keyOf(%q) = %q reads as a key record", nick, reply)
+		}
+	}
+}
+
+func TestObserveOnlyTakesRequestedKeys(t *testing.T) {
+	self := []byte("our own key")
+	store, err := loadContacts(filepath.Join(t.TempDir(), "contacts"), self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(self)
+	selfFingerprint := fmt.Sprintf("%X", sum[:])
+
+	// Unsolicited records plant nothing
+	if notes := store.observe("KEY @alice AAAA alice"); notes != nil || store.contacts["alice"] != nil {
+		t.Fatalf("unrequested key stored: %q", notes)
+	}
+	store.observe("KEY @me " + selfFingerprint + " me")
+	if store.selfName() != "" {
+		t.Error("unrequested own name taken")
+	}
+
+	store.lookup("@alice")
+	if notes := store.observe("KEY @alice AAAA alice"); len(notes) != 1 || !strings.HasPrefix(notes[0], "New contact") {
+		t.Fatalf("looked up key: %q", notes)
+	}
+
+	// A forged change of a known key raises no warning, and leaves the
+	// warning for a real one
+	if notes := store.observe("KEY @alice BBBB alice"); notes != nil {
+		t.Errorf("unrequested key change: %q", notes)
+	}
+	store.looked = map[string]bool{}
+	store.lookup("@Alice")
+	if notes := store.observe("KEY @alice CCCC alice"); len(notes) == 0 || !strings.HasPrefix(notes[0], "WARNING") {
+		t.Errorf("real key change: %q", notes)
+	}
+
+	store.lookupSelf()
+	store.observe("KEY @me " + selfFingerprint + " me")
+	if store.selfName() != "@me" {
+		t.Errorf("own name %q, want @me", store.selfName())
+	}
+}
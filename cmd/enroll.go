@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Validity of certificates issued through enrollment
+const enrollDays = 365
+
+// enrollment is a certificate signing request waiting for an operator.
+// The certificate is issued for the checked common name alone, whatever
+// else the CSR asks for.
+type enrollment struct {
+	id    uint64
+	csr   *x509.CertificateRequest
+	name  string // common name of the certificate to issue
+	keyID string
+	addr  string
+	token bool // a bootstrap token came with the request
+	since time.Time
+}
+
+// CA state of a server started with -ca
+var (
+	serverCA *certAuthority
+
+	enrollMu      sync.Mutex
+	enrollLastID  uint64
+	enrollments   = make(map[uint64]*enrollment)
+	enrollTokens  = make(map[string]bool)
+	enrollWaiting = make(map[string]*Client)
+	issuedCerts   = make(map[string][]byte)
+)
+
+// loadEnrollment opens the -ca directory and reads the bootstrap tokens.
+// The CA's CRL is used unless -crl names another one.
+func loadEnrollment() error {
+	ca, err := loadCA(*caDir, []byte(*caPass))
+	if err != nil {
+		return err
+	}
+	serverCA = ca
+
+	for _, token := range strings.Split(*enrollTok, ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			enrollTokens[token] = true
+		}
+	}
+	if *crlFile == "" {
+		*crlFile = filepath.Join(*caDir, "crl.pem")
+	}
+	return nil
+}
+
+// submitEnrollment handles "ENROLL <token|-> <base64 CSR>" from a client
+// and returns the reply. The CSR must be for the key the client used to
+// connect. Every request waits for an operator to approve it; when
+// -enrolltoken is set, a request must also bring one of the tokens, which
+// is then used up.
+func submitEnrollment(client *Client, args string) string {
+	if serverCA == nil {
+		return "Enrollment is not enabled on this server.\n"
+	}
+	token, encoded, _ := strings.Cut(args, " ")
+	der, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "Malformed enrollment request.\n"
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err == nil {
+		err = csr.CheckSignature()
+	}
+	if err != nil {
+		return "Invalid certificate signing request: " + err.Error() + ".\n"
+	}
+	if !bytes.Equal(csr.RawSubjectPublicKeyInfo, client.clientCert.RawSubjectPublicKeyInfo) {
+		return "The certificate signing request is not for the key of this connection.\n"
+	}
+
+	name := csr.Subject.CommonName
+	if name == "" || sanitizeNick(name) != name {
+		return "The certificate signing request needs a common name of letters, digits, \"-\", \"_\" and \".\".\n"
+	}
+
+	enrollMu.Lock()
+	for _, e := range enrollments {
+		if e.keyID == client.keyID {
+			enrollMu.Unlock()
+			return fmt.Sprintf("Enrollment request %d is already waiting for approval.\n", e.id)
+		}
+		if strings.EqualFold(e.name, name) {
+			enrollMu.Unlock()
+			return "Another request for " + name + " is waiting for approval.\n"
+		}
+	}
+	validToken := token != "-" && enrollTokens[token]
+	if len(enrollTokens) > 0 && !validToken {
+		enrollMu.Unlock()
+		auditAuth("refuse", client.clientCert, "reason", "enroll-token", "keyid", client.keyID)
+		return "A valid enrollment token is required.\n"
+	}
+	if err := checkEnrollmentName(name); err != nil {
+		enrollMu.Unlock()
+		return err.Error() + ".\n"
+	}
+	delete(enrollTokens, token)
+	enrollLastID++
+	e := &enrollment{id: enrollLastID, csr: csr, name: name, keyID: client.keyID,
+		addr: logAddr(client.conn.RemoteAddr()), token: validToken, since: time.Now()}
+	enrollments[e.id] = e
+	enrollMu.Unlock()
+
+	auditAuth("enroll", client.clientCert, "id", fmt.Sprint(e.id), "keyid", client.keyID,
+		"request", csr.Subject.String(), "name", name, "token", fmt.Sprint(validToken))
+
+	for _, c := range hub.connected() {
+		if c.oper {
+			c.send(fmt.Sprintf("*** Enrollment request %d from %s for CN=%s.\n", e.id, client.name(), name))
+		}
+	}
+	return fmt.Sprintf("Enrollment request %d for CN=%s is waiting for operator approval.\n", e.id, name)
+}
+
+// checkEnrollmentName refuses a common name that a valid certificate of the
+// CA already carries, so that enrolling cannot take over an identity.
+func checkEnrollmentName(name string) error {
+	entries, err := serverCA.index()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.status != "V" || time.Now().After(entry.expiry) {
+			continue
+		}
+		for _, rdn := range strings.Split(entry.subject, ",") {
+			if strings.EqualFold(rdn, "CN="+name) {
+				return errors.New("a certificate for " + name + " has already been issued")
+			}
+		}
+	}
+	return nil
+}
+
+// issueEnrollment signs an enrollment request, stores the certificate
+// under certs/ in the CA directory and delivers it to the requester.
+func issueEnrollment(e *enrollment) (*x509.Certificate, error) {
+	if err := checkEnrollmentName(e.name); err != nil {
+		return nil, err
+	}
+	// Nothing but the key and the checked name is taken from the CSR
+	subject, err := asn1.Marshal(pkix.Name{CommonName: e.name}.ToRDNSequence())
+	if err != nil {
+		return nil, err
+	}
+	csr := *e.csr
+	csr.RawSubject, csr.EmailAddresses, csr.DNSNames, csr.IPAddresses = subject, nil, nil, nil
+	if err := os.MkdirAll(filepath.Join(serverCA.dir, "certs"), 0700); err != nil {
+		return nil, err
+	}
+	cert, err := serverCA.sign(&csr, enrollDays, false)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(serverCA.dir, "certs", fmt.Sprintf("%X.pem", cert.SerialNumber))
+	if err := writePEM(path, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}, 0644); err != nil {
+		return nil, err
+	}
+	logInfo("certificate issued", "id", e.id, "serial", fmt.Sprintf("%X", cert.SerialNumber), "keyid", e.keyID)
+
+	enrollMu.Lock()
+	issuedCerts[e.keyID] = cert.Raw
+	enrollMu.Unlock()
+	deliverCertificate(e.keyID)
+	return cert, nil
+}
+
+// deliverCertificate sends an issued certificate to the connected sessions
+// of its key, keeping it for the next connection if there are none.
+func deliverCertificate(keyID string) {
+	enrollMu.Lock()
+	defer enrollMu.Unlock()
+
+	der, ok := issuedCerts[keyID]
+	if !ok {
+		return
+	}
+	sessions := hub.sessionsOf(keyID)
+	if waiting := enrollWaiting[keyID]; waiting != nil {
+		sessions = append(sessions, waiting)
+	}
+	for _, session := range sessions {
+		session.send("CERTIFICATE " + base64.StdEncoding.EncodeToString(der) + "\n")
+	}
+	if len(sessions) > 0 {
+		delete(issuedCerts, keyID)
+	}
+}
+
+func approveEnrollment(id uint64) (*x509.Certificate, error) {
+	enrollMu.Lock()
+	e, ok := enrollments[id]
+	delete(enrollments, id)
+	enrollMu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("no such enrollment request: %d", id)
+	}
+	return issueEnrollment(e)
+}
+
+func rejectEnrollment(id uint64) error {
+	enrollMu.Lock()
+	e, ok := enrollments[id]
+	delete(enrollments, id)
+	var sessions []*Client
+	if ok {
+		sessions = hub.sessionsOf(e.keyID)
+		if waiting := enrollWaiting[e.keyID]; waiting != nil {
+			sessions = append(sessions, waiting)
+		}
+	}
+	enrollMu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("no such enrollment request: %d", id)
+	}
+	for _, session := range sessions {
+		session.send(fmt.Sprintf("Enrollment request %d was rejected.\n", id))
+	}
+	return nil
+}
+
+// listEnrollments describes the requests waiting for approval.
+func listEnrollments() string {
+	enrollMu.Lock()
+	defer enrollMu.Unlock()
+
+	ids := make([]uint64, 0, len(enrollments))
+	for id := range enrollments {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var list string
+	for _, id := range ids {
+		e := enrollments[id]
+		list += fmt.Sprintf("%d keyid=%s subject=%q request=%q token=%v ip=%s since=%s\n",
+			e.id, e.keyID, "CN="+e.name, e.csr.Subject.String(), e.token, e.addr, e.since.Format("2006-01-02 15:04:05"))
+	}
+	return list
+}
+
+// enrollSession serves a client whose certificate was not issued by the
+// server's CA: it may only enroll, then reconnect with the new
+// certificate.
+func enrollSession(conn net.Conn, cert *x509.Certificate, keyID string) {
+	client := newClient(conn, "@enroll", cert, keyID)
+	go client.writeLoop()
+	defer client.close()
+
+	enrollMu.Lock()
+	if enrollWaiting[keyID] != nil {
+		enrollMu.Unlock()
+		client.send("This key is already enrolling from another connection.\n")
+		return
+	}
+	enrollWaiting[keyID] = client
+	enrollMu.Unlock()
+	defer func() {
+		enrollMu.Lock()
+		delete(enrollWaiting, keyID)
+		enrollMu.Unlock()
+	}()
+
+	logInfo("enrollment session", "keyid", keyID, "ip", logAddr(conn.RemoteAddr()))
+	client.send("Your certificate was not issued by this server. Use ENROLL [token] to request one.\n")
+	deliverCertificate(keyID)
+
+	reader := bufio.NewReader(conn)
+	for {
+		message, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		message = strings.TrimSpace(message)
+
+		switch {
+		case strings.HasPrefix(message, "ENROLL "):
+			client.send(submitEnrollment(client, strings.TrimPrefix(message, "ENROLL ")))
+		case strings.HasPrefix(message, "QUIT"):
+			return
+		default:
+			client.send("You must enroll first. Use ENROLL [token] to request a certificate.\n")
+		}
+	}
+}
+
+// enrollRequest builds the "ENROLL" line a client sends for its own key
+// and certificate subject.
+func enrollRequest(cert tls.Certificate, token string) (string, error) {
+	if len(cert.Certificate) == 0 {
+		return "", errors.New("no client certificate")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return "", err
+	}
+	signer, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return "", errors.New("client key cannot sign")
+	}
+	template := &x509.CertificateRequest{
+		RawSubject:     leaf.RawSubject,
+		EmailAddresses: leaf.EmailAddresses,
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, signer)
+	if err != nil {
+		return "", err
+	}
+	if token == "" {
+		token = "-"
+	}
+	return "ENROLL " + token + " " + base64.StdEncoding.EncodeToString(der), nil
+}
+
+// saveIssuedCertificate writes a certificate received with "CERTIFICATE"
+// next to the -cert file and returns its path.
+func saveIssuedCertificate(encoded string) (string, error) {
+	der, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	if _, err := x509.ParseCertificate(der); err != nil {
+		return "", err
+	}
+	ext := filepath.Ext(*certFile)
+	path := strings.TrimSuffix(*certFile, ext) + ".issued" + ext
+	if ext == "" {
+		path += ".pem"
+	}
+	return path, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
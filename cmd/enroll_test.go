@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// setTestCA makes a new CA the server's enrollment CA for a test.
+func setTestCA(t *testing.T, tokens ...string) {
+	t.Helper()
+	dir := t.TempDir()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err := initCA(dir, key, pkix.Name{CommonName: "Test CA"}, 30, "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	ca, err := loadCA(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enrollMu.Lock()
+	savedCA, savedTokens, savedRequests := serverCA, enrollTokens, enrollments
+	serverCA, enrollTokens, enrollments = ca, make(map[string]bool), make(map[uint64]*enrollment)
+	for _, token := range tokens {
+		enrollTokens[token] = true
+	}
+	enrollMu.Unlock()
+	t.Cleanup(func() {
+		enrollMu.Lock()
+		serverCA, enrollTokens, enrollments = savedCA, savedTokens, savedRequests
+		enrollMu.Unlock()
+	})
+}
+
+// enrollingClient is a connection with a self-signed certificate, and the
+// "ENROLL" arguments of a CSR for its key with the given subject.
+func enrollingClient(t *testing.T, token string, subject pkix.Name) (*Client, string) {
+	t.Helper()
+	cert, key := newTestCert(t, testCert{subject: "self-signed"})
+	server, peer := net.Pipe()
+	t.Cleanup(func() { server.Close(); peer.Close() })
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:        subject,
+		EmailAddresses: []string{"admin@example.com"},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newClient(server, "@enroll", cert, clientKeyID(cert))
+	return client, token + " " + base64.StdEncoding.EncodeToString(der)
+}
+
+func TestEnrollmentNeedsApproval(t *testing.T) {
+	setAuditOutput(t, nil, false)
+	setTestCA(t, "7f3c9a")
+	subject := pkix.Name{CommonName: "mallory", Organization: []string{"Operators"}}
+
+	client, args := enrollingClient(t, "-", subject)
+	if reply := submitEnrollment(client, args); !strings.Contains(reply, "token is required") {
+		t.Errorf("request without a token: %q", reply)
+	}
+	client, args = enrollingClient(t, "7f3c9a", subject)
+	if reply := submitEnrollment(client, args); !strings.Contains(reply, "waiting for operator approval") {
+		t.Fatalf("request with a token: %q", reply)
+	}
+	if entries, _ := serverCA.index(); len(entries) != 0 {
+		t.Fatalf("certificate issued before approval: %v", entries)
+	}
+	if enrollTokens["7f3c9a"] {
+		t.Error("token not used up")
+	}
+
+	cert, err := approveEnrollment(enrollLastID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cert.Subject.String(); got != "CN=mallory" {
+		t.Errorf("issued subject %q, want only the common name", got)
+	}
+	if len(cert.EmailAddresses) != 0 {
+		t.Errorf("issued e-mail addresses %v from the CSR", cert.EmailAddresses)
+	}
+
+	// The name is taken now, for any other key
+	other, args := enrollingClient(t, "-", pkix.Name{CommonName: "Mallory"})
+	enrollMu.Lock()
+	enrollTokens = map[string]bool{}
+	enrollMu.Unlock()
+	if reply := submitEnrollment(other, args); !strings.Contains(reply, "already been issued") {
+		t.Errorf("second request for an issued name: %q", reply)
+	}
+}
+
+func TestEnrollmentChecksName(t *testing.T) {
+	setAuditOutput(t, nil, false)
+	setTestCA(t)
+
+	for _, name := range []string{"", "CN=admin,O=x", "alice bob", "ev\x1bil"} {
+		client, args := enrollingClient(t, "-", pkix.Name{CommonName: name})
+		if reply := submitEnrollment(client, args); strings.Contains(reply, "waiting") {
+			t.Errorf("common name %q accepted", name)
+		}
+	}
+
+	first, args := enrollingClient(t, "-", pkix.Name{CommonName: "alice"})
+	if reply := submitEnrollment(first, args); !strings.Contains(reply, "waiting") {
+		t.Fatalf("first request: %q", reply)
+	}
+	second, args := enrollingClient(t, "-", pkix.Name{CommonName: "alice"})
+	if reply := submitEnrollment(second, args); !strings.Contains(reply, "Another request") {
+		t.Errorf("second pending request for the same name: %q", reply)
+	}
+}
+
+func TestLoadEnrollmentCreatesNothing(t *testing.T) {
+	setTestCA(t)
+	dir := t.TempDir()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err := initCA(dir, key, pkix.Name{CommonName: "Test CA"}, 30, "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	setFlag(t, "cadir", dir)
+	setFlag(t, "crl", "")
+
+	if err := loadEnrollment(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "certs")); !os.IsNotExist(err) {
+		t.Errorf("loading the CA created certs/: %v", err)
+	}
+}
+
+func TestRevokeRewritesIndex(t *testing.T) {
+	setTestCA(t)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "alice"}}, key)
+	csr, _ := x509.ParseCertificateRequest(der)
+	cert, err := serverCA.sign(csr, 30, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := serverCA.revoke(cert.SerialNumber, 7); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := serverCA.index()
+	if err != nil || len(entries) != 1 || entries[0].status != "R" {
+		t.Fatalf("index after revocation: %v, %v", entries, err)
+	}
+	info, err := os.Stat(filepath.Join(serverCA.dir, "index.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm&0077 != 0 && runtime.GOOS != "windows" {
+		t.Errorf("index.txt rewritten with mode %o", perm)
+	}
+	files, _ := filepath.Glob(filepath.Join(serverCA.dir, ".index.txt.*"))
+	if len(files) != 0 {
+		t.Errorf("temporary files left: %v", files)
+	}
+}
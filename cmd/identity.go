@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// OIDs used to derive user identities from certificates
+var (
+	uidOID            = asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 1}
+	subjectAltNameOID = asn1.ObjectIdentifier{2, 5, 29, 17}
+	upnOID            = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 20, 2, 3}
+)
+
+var identityPlaceholder = regexp.MustCompile(`\{([a-z]+)\}`)
+
+// mapIdentity derives a user identity from a certificate according to
+// spec, which is either an attribute name (cn, uid, email, upn, serial,
+// o, ou) or a template combining them such as "{uid}.{o}".
+func mapIdentity(cert *x509.Certificate, spec string) (string, error) {
+	if !strings.Contains(spec, "{") {
+		spec = "{" + spec + "}"
+	}
+
+	var err error
+	identity := identityPlaceholder.ReplaceAllStringFunc(spec, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+		value, ok := certAttribute(cert, name)
+		if !ok {
+			err = errors.New("unknown identity attribute " + name)
+		} else if value == "" && err == nil {
+			err = errors.New("certificate has no " + name + " attribute")
+		}
+		return value
+	})
+	if err != nil {
+		return "", err
+	}
+	return identity, nil
+}
+
+// checkIdentitySpec checks that an identity spec only names known
+// certificate attributes.
+func checkIdentitySpec(spec string) error {
+	if !strings.Contains(spec, "{") {
+		spec = "{" + spec + "}"
+	}
+	for _, match := range identityPlaceholder.FindAllStringSubmatch(spec, -1) {
+		if _, ok := certAttribute(&x509.Certificate{}, match[1]); !ok {
+			return errors.New("unknown identity attribute " + match[1])
+		}
+	}
+	return nil
+}
+
+// certAttribute returns the named attribute of a certificate. The boolean
+// is false if the name is not a known attribute.
+func certAttribute(cert *x509.Certificate, name string) (string, bool) {
+	switch name {
+	case "cn":
+		return strings.TrimPrefix(cert.Subject.CommonName, "CN="), true
+	case "uid":
+		for _, atv := range cert.Subject.Names {
+			if atv.Type.Equal(uidOID) {
+				if value, ok := atv.Value.(string); ok {
+					return value, true
+				}
+			}
+		}
+		return "", true
+	case "email":
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0], true
+		}
+		return "", true
+	case "upn":
+		return getClientUPN(cert), true
+	case "serial":
+		return fmt.Sprintf("%X", cert.SerialNumber), true
+	case "o":
+		if len(cert.Subject.Organization) > 0 {
+			return cert.Subject.Organization[0], true
+		}
+		return "", true
+	case "ou":
+		if len(cert.Subject.OrganizationalUnit) > 0 {
+			return cert.Subject.OrganizationalUnit[0], true
+		}
+		return "", true
+	}
+	return "", false
+}
+
+type otherName struct {
+	TypeID asn1.ObjectIdentifier
+	Value  asn1.RawValue `asn1:"tag:0,explicit"`
+}
+
+func getClientUPN(cert *x509.Certificate) string {
+	// Get the Microsoft UPN otherName from the Subject Alternative Name
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(subjectAltNameOID) {
+			continue
+		}
+		var names []asn1.RawValue
+		if _, err := asn1.Unmarshal(ext.Value, &names); err != nil {
+			return ""
+		}
+		for _, name := range names {
+			if name.Class != asn1.ClassContextSpecific || name.Tag != 0 {
+				continue
+			}
+			var other otherName
+			if _, err := asn1.UnmarshalWithParams(name.FullBytes, &other, "tag:0"); err != nil {
+				continue
+			}
+			if !other.TypeID.Equal(upnOID) {
+				continue
+			}
+			var upn string
+			if _, err := asn1.Unmarshal(other.Value.Bytes, &upn); err == nil {
+				return upn
+			}
+		}
+	}
+	return ""
+}
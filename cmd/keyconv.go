@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/pedroalbanese/gogost/gost3410"
+)
+
+// readKeyBlock reads the PEM private key block of a file.
+func readKeyBlock(path string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New(path + ": no PEM private key found")
+	}
+	return block, nil
+}
+
+// describePublicKey names the algorithm and size of a key.
+func describePublicKey(key crypto.PublicKey) string {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d bits", k.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA " + k.Curve.Params().Name
+	case ed25519.PublicKey:
+		return "Ed25519"
+	case *gost3410.PublicKey:
+		return fmt.Sprintf("GOST R 34.10-2012 %d bits (%s)", k.C.PointSize()*8, k.C.Name)
+	}
+	return fmt.Sprintf("%T", key)
+}
+
+// keyInfo describes the format and encryption of a PEM private key and,
+// when it can be decrypted, the key itself.
+func keyInfo(block *pem.Block, password []byte) ([]string, error) {
+	var info []string
+	switch {
+	case IsEncryptedPKCS8Block(block):
+		scheme, err := inspectPKCS8(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		info = append(info, "format: PKCS#8 (PBES2)", "cipher: "+scheme.cipher, "iv: "+hex.EncodeToString(scheme.iv))
+		if scheme.kdf == "scrypt" {
+			info = append(info, fmt.Sprintf("kdf: scrypt (N=%d, r=%d, p=%d)", scheme.n, scheme.r, scheme.p))
+		} else {
+			info = append(info, fmt.Sprintf("kdf: %s (%d iterations)", scheme.kdf, scheme.iterations))
+		}
+		info = append(info, "salt: "+hex.EncodeToString(scheme.salt))
+	case IsEncryptedPEMBlock(block):
+		dek, err := parseDEKInfo(block.Headers["DEK-Info"])
+		if err != nil {
+			return nil, err
+		}
+		info = append(info, "format: "+block.Type+" (DEK-Info)", "cipher: "+dek.alg.name, "iv: "+hex.EncodeToString(dek.iv))
+		if dek.alg.aead != nil {
+			info = append(info, fmt.Sprintf("kdf: %s (%d iterations)", dek.alg.kdf, dek.iterations), "salt: "+hex.EncodeToString(dek.salt))
+		} else {
+			info = append(info, "kdf: legacy (MD5)")
+		}
+	default:
+		info = append(info, "format: "+block.Type, "cipher: none")
+	}
+
+	if (IsEncryptedPKCS8Block(block) || IsEncryptedPEMBlock(block)) && len(password) == 0 {
+		return append(info, "key: encrypted, give -pwd to show it"), nil
+	}
+	der, err := decryptPrivateKeyBlock(block, password)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parsePrivateKeyDER(block.Type, der)
+	if err != nil {
+		return nil, err
+	}
+	info = append(info, "key: "+describePublicKey(key.Public()))
+	if spki, err := x509.MarshalPKIXPublicKey(key.Public()); err == nil {
+		sum := sha256.Sum256(spki)
+		info = append(info, "public key SHA-256: "+hex.EncodeToString(sum[:]))
+	}
+	return info, nil
+}
+
+// changeKeyPassword re-encrypts a key under a new password, keeping its
+// format, cipher and key derivation function.
+func changeKeyPassword(block *pem.Block, password, newPassword []byte) (*pem.Block, error) {
+	der, err := decryptPrivateKeyBlock(block, password)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case IsEncryptedPKCS8Block(block):
+		scheme, err := inspectPKCS8(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return EncryptPKCS8(rand.Reader, der, newPassword, scheme.cipher, scheme.kdf)
+	case IsEncryptedPEMBlock(block):
+		mode, _, _ := strings.Cut(block.Headers["DEK-Info"], ",")
+		return EncryptPEMBlock(rand.Reader, block.Type, der, newPassword, cipherByName(mode).cipher)
+	}
+	return nil, errors.New("private key is not encrypted, use \"ircs key convert\"")
+}
+
+// decryptedKeyBlock returns the unencrypted PEM form of a key.
+func decryptedKeyBlock(block *pem.Block, password []byte) (*pem.Block, error) {
+	der, err := decryptPrivateKeyBlock(block, password)
+	if err != nil {
+		return nil, err
+	}
+	if IsEncryptedPKCS8Block(block) {
+		return &pem.Block{Type: "PRIVATE KEY", Bytes: der}, nil
+	}
+	return &pem.Block{Type: block.Type, Bytes: der}, nil
+}
+
+// keyCommand implements "ircs key info|passwd|convert|decrypt".
+func keyCommand(args []string) {
+	usage := "Usage of ircs key: <info|passwd|convert|decrypt> -in <file> [flags]"
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("key "+args[0], flag.ExitOnError)
+	in := fs.String("in", "", "Private key file.")
+	pwd := fs.String("pwd", "", "Password of the private key.")
+	out := fs.String("out", "", "Output file. (default stdout)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+
+	var newPwd, cipherName, kdf *string
+	switch args[0] {
+	case "info", "decrypt":
+	case "passwd":
+		newPwd = fs.String("newpwd", "", "New password.")
+	case "convert":
+		newPwd = fs.String("newpwd", "", "New password. (default -pwd)")
+		cipherName = fs.String("cipher", "AES-256-CBC", "Private key encryption cipher.")
+		kdf = fs.String("kdf", "pbkdf2", "Private key encryption: <"+strings.Join(keyKDFs, "|")+">")
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	fs.Parse(args[1:])
+	if *in == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	block, err := readKeyBlock(*in)
+	if err != nil {
+		log.Fatal(err)
+	}
+	switch args[0] {
+	case "info":
+		info, err := keyInfo(block, []byte(*pwd))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(strings.Join(info, "\n"))
+		return
+	case "passwd":
+		if *newPwd == "" {
+			log.Fatal("a new password is required, use \"ircs key decrypt\" to remove it")
+		}
+		block, err = changeKeyPassword(block, []byte(*pwd), []byte(*newPwd))
+	case "convert":
+		if *newPwd == "" {
+			*newPwd = *pwd
+		}
+		if *newPwd == "" {
+			log.Fatal("a password is required, use -newpwd")
+		}
+		var key crypto.Signer
+		if key, err = parsePrivateKey(pem.EncodeToMemory(block), []byte(*pwd)); err == nil {
+			block, err = encodePrivateKey(key, *newPwd, *cipherName, *kdf)
+		}
+	case "decrypt":
+		block, err = decryptedKeyBlock(block, []byte(*pwd))
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := writePEM(*out, block, 0600); err != nil {
+		log.Fatal(err)
+	}
+}
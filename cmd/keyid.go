@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+
+	"github.com/pedroalbanese/gogost/gost34112012256"
+)
+
+// Key identifier methods accepted by the -keyid flag
+var keyIDMethods = []string{"skid", "sha256", "streebog", "rfc7093-1", "rfc7093-2", "rfc7093-3"}
+
+type subjectPublicKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+func checkKeyIDMethod(method string) error {
+	for _, m := range keyIDMethods {
+		if m == method {
+			return nil
+		}
+	}
+	return errors.New("unknown key identifier method: " + method)
+}
+
+// keyIDFromKey reports whether the -keyid method derives key IDs from the
+// public key, so that a certificate cannot claim another one's key ID.
+func keyIDFromKey() bool {
+	return *keyIDAlg != "skid"
+}
+
+// clientKeyID returns the identifier used to recognize a client key
+// across sessions, computed with the -keyid method. The "skid" method
+// uses the Subject Key Identifier extension and falls back to the SHA-256
+// hash of the SubjectPublicKeyInfo when the certificate has none.
+func clientKeyID(cert *x509.Certificate) string {
+	switch *keyIDAlg {
+	case "streebog":
+		hash := gost34112012256.New()
+		hash.Write(cert.RawSubjectPublicKeyInfo)
+		return fmt.Sprintf("%X", hash.Sum(nil))
+	case "rfc7093-1", "rfc7093-2", "rfc7093-3":
+		// RFC 7093 methods 1 to 3: leftmost 160 bits of the SHA-256,
+		// SHA-384 or SHA-512 hash of the subjectPublicKey bits
+		var spki subjectPublicKeyInfo
+		if _, err := asn1.Unmarshal(cert.RawSubjectPublicKeyInfo, &spki); err != nil {
+			break
+		}
+		var sum []byte
+		switch *keyIDAlg {
+		case "rfc7093-1":
+			digest := sha256.Sum256(spki.PublicKey.Bytes)
+			sum = digest[:]
+		case "rfc7093-2":
+			digest := sha512.Sum384(spki.PublicKey.Bytes)
+			sum = digest[:]
+		default:
+			digest := sha512.Sum512(spki.PublicKey.Bytes)
+			sum = digest[:]
+		}
+		return fmt.Sprintf("%X", sum[:20])
+	case "skid":
+		if skid := getClientSKID(cert); skid != "" {
+			return skid
+		}
+	}
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return fmt.Sprintf("%X", digest[:])
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pedroalbanese/gogost/gost3410"
+)
+
+// Key algorithms accepted by keygen and ca init
+var keyAlgorithms = []string{"rsa", "ecdsa", "ed25519", "gost2012-256", "gost2012-512"}
+
+// Private key encryption schemes accepted by -kdf: PKCS#8 PBES2, or the
+// legacy DEK-Info PEM encryption
+var keyKDFs = []string{"pbkdf2", "pbkdf2-sha512", "pbkdf2-streebog", "pbkdf2-streebog256", "scrypt", "legacy"}
+
+// Subject attributes accepted in a DN such as "CN=alice,O=Example"
+var subjectAttributes = map[string]asn1.ObjectIdentifier{
+	"CN":           {2, 5, 4, 3},
+	"SERIALNUMBER": {2, 5, 4, 5},
+	"C":            {2, 5, 4, 6},
+	"L":            {2, 5, 4, 7},
+	"ST":           {2, 5, 4, 8},
+	"STREET":       {2, 5, 4, 9},
+	"O":            {2, 5, 4, 10},
+	"OU":           {2, 5, 4, 11},
+	"UID":          uidOID,
+	"EMAIL":        emailAddressOID,
+}
+
+// PKCS#9 emailAddress, an IA5String (RFC 5280, appendix A.1)
+var emailAddressOID = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
+
+// generateKey creates a private key. For ECDSA, curve is P-256, P-384 or
+// P-521; for GOST it is the parameter set letter.
+func generateKey(alg string, bits int, curve string) (crypto.Signer, error) {
+	switch alg {
+	case "rsa":
+		return rsa.GenerateKey(rand.Reader, bits)
+	case "ecdsa":
+		curves := map[string]elliptic.Curve{"": elliptic.P256(), "P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		c, ok := curves[curve]
+		if !ok {
+			return nil, errors.New("unknown ECDSA curve: " + curve)
+		}
+		return ecdsa.GenerateKey(c, rand.Reader)
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	case "gost2012-256":
+		curves := map[string]*gost3410.Curve{
+			"":  gost3410.CurveIdtc26gost34102012256paramSetA(),
+			"A": gost3410.CurveIdtc26gost34102012256paramSetA(),
+			"B": gost3410.CurveIdtc26gost34102012256paramSetB(),
+			"C": gost3410.CurveIdtc26gost34102012256paramSetC(),
+			"D": gost3410.CurveIdtc26gost34102012256paramSetD(),
+		}
+		c, ok := curves[curve]
+		if !ok {
+			return nil, errors.New("unknown GOST R 34.10-2012 256-bit parameter set: " + curve)
+		}
+		return gost3410.GenPrivateKey(c, rand.Reader)
+	case "gost2012-512":
+		curves := map[string]*gost3410.Curve{
+			"":  gost3410.CurveIdtc26gost34102012512paramSetA(),
+			"A": gost3410.CurveIdtc26gost34102012512paramSetA(),
+			"B": gost3410.CurveIdtc26gost34102012512paramSetB(),
+			"C": gost3410.CurveIdtc26gost34102012512paramSetC(),
+		}
+		c, ok := curves[curve]
+		if !ok {
+			return nil, errors.New("unknown GOST R 34.10-2012 512-bit parameter set: " + curve)
+		}
+		return gost3410.GenPrivateKey(c, rand.Reader)
+	}
+	return nil, errors.New("unknown key algorithm: " + alg)
+}
+
+// encodePrivateKey encodes a key as PKCS#8 PEM. When a password is given
+// it is encrypted as PKCS#8 PBES2 with the kdf, or with the legacy
+// DEK-Info header if kdf is "legacy".
+func encodePrivateKey(key crypto.Signer, password, cipherName, kdf string) (*pem.Block, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if password == "" {
+		return &pem.Block{Type: "PRIVATE KEY", Bytes: der}, nil
+	}
+	if kdf != "legacy" {
+		return EncryptPKCS8(rand.Reader, der, []byte(password), cipherName, kdf)
+	}
+	alg := cipherByName(cipherName)
+	if alg == nil {
+		return nil, errors.New("unknown cipher: " + cipherName)
+	}
+	return EncryptPEMBlock(rand.Reader, "PRIVATE KEY", der, []byte(password), alg.cipher)
+}
+
+// writePEM writes a PEM block to path, or to stdout if path is empty.
+func writePEM(path string, block *pem.Block, perm os.FileMode) error {
+	if path == "" {
+		return pem.Encode(os.Stdout, block)
+	}
+	return replaceFile(path, pem.EncodeToMemory(block), perm)
+}
+
+// replaceFile writes data to a new file with the given permissions and
+// renames it over path. An existing file never keeps its old permissions,
+// and is never left partly written.
+func replaceFile(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// parseSubject parses a DN such as "CN=alice,O=Example,C=BR". Commas
+// inside a value are escaped with a backslash.
+func parseSubject(dn string) (pkix.Name, error) {
+	var name pkix.Name
+	var parts []string
+	var current strings.Builder
+	for i := 0; i < len(dn); i++ {
+		switch {
+		case dn[i] == '\\' && i+1 < len(dn):
+			i++
+			current.WriteByte(dn[i])
+		case dn[i] == ',':
+			parts = append(parts, current.String())
+			current.Reset()
+		default:
+			current.WriteByte(dn[i])
+		}
+	}
+	parts = append(parts, current.String())
+
+	for _, part := range parts {
+		attr, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return name, fmt.Errorf("malformed subject attribute %q", strings.TrimSpace(part))
+		}
+		oid, ok := subjectAttributes[strings.ToUpper(strings.TrimSpace(attr))]
+		if !ok {
+			return name, fmt.Errorf("unknown subject attribute %q", strings.TrimSpace(attr))
+		}
+		var encoded interface{} = strings.TrimSpace(value)
+		if oid.Equal(emailAddressOID) {
+			raw, err := ia5String(strings.TrimSpace(value))
+			if err != nil {
+				return name, err
+			}
+			encoded = raw
+		}
+		name.ExtraNames = append(name.ExtraNames, pkix.AttributeTypeAndValue{Type: oid, Value: encoded})
+	}
+	return name, nil
+}
+
+// ia5String encodes an ASCII string as an ASN.1 IA5String, which
+// encoding/asn1 only produces for tagged struct fields.
+func ia5String(s string) (asn1.RawValue, error) {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return asn1.RawValue{}, fmt.Errorf("%q is not an IA5String", s)
+		}
+	}
+	return asn1.RawValue{Tag: asn1.TagIA5String, Bytes: []byte(s)}, nil
+}
+
+// keygenCommand implements "ircs keygen".
+func keygenCommand(args []string) {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	alg := fs.String("alg", "ecdsa", "Key algorithm: <"+strings.Join(keyAlgorithms, "|")+">")
+	bits := fs.Int("bits", 3072, "RSA key size.")
+	curve := fs.String("curve", "", "ECDSA curve <P-256|P-384|P-521> or GOST parameter set <A|B|C|D>.")
+	out := fs.String("out", "", "Private key output file. (default stdout)")
+	pub := fs.String("pub", "", "Public key output file.")
+	pwd := fs.String("pwd", "", "Password to encrypt the private key with.")
+	cipherName := fs.String("cipher", "AES-256-CBC", "Private key encryption cipher.")
+	kdf := fs.String("kdf", "pbkdf2", "Private key encryption: <"+strings.Join(keyKDFs, "|")+">")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage of ircs keygen:")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	key, err := generateKey(*alg, *bits, *curve)
+	if err != nil {
+		log.Fatal(err)
+	}
+	block, err := encodePrivateKey(key, *pwd, *cipherName, *kdf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := writePEM(*out, block, 0600); err != nil {
+		log.Fatal(err)
+	}
+
+	if *pub != "" {
+		der, err := x509.MarshalPKIXPublicKey(key.Public())
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := writePEM(*pub, &pem.Block{Type: "PUBLIC KEY", Bytes: der}, 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// reqCommand implements "ircs req", creating a certificate signing request.
+func reqCommand(args []string) {
+	fs := flag.NewFlagSet("req", flag.ExitOnError)
+	keyPath := fs.String("key", "", "Private key file.")
+	pwd := fs.String("pwd", "", "Password of the private key.")
+	subject := fs.String("subject", "", "Subject DN, e.g. \"CN=alice,O=Example\".")
+	emails := fs.String("email", "", "E-mail addresses. (comma-separated)")
+	hosts := fs.String("hosts", "", "DNS names and IP addresses, for server certificates. (comma-separated)")
+	out := fs.String("out", "", "CSR output file. (default stdout)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage of ircs req:")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *keyPath == "" || *subject == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	key, err := loadPrivateKey(*keyPath, []byte(*pwd))
+	if err != nil {
+		log.Fatal(err)
+	}
+	name, err := parseSubject(*subject)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	template := &x509.CertificateRequest{Subject: name}
+	for _, email := range strings.Split(*emails, ",") {
+		if email = strings.TrimSpace(email); email != "" {
+			template.EmailAddresses = append(template.EmailAddresses, email)
+		}
+	}
+	for _, host := range strings.Split(*hosts, ",") {
+		if host = strings.TrimSpace(host); host == "" {
+			continue
+		} else if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := writePEM(*out, &pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestWritePEMReplacesMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no Unix permissions")
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writePEM(path, &pem.Block{Type: "PRIVATE KEY", Bytes: []byte{1, 2, 3}}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("rewritten key has mode %o", perm)
+	}
+	if block, _ := pem.Decode(mustRead(t, path)); block == nil || block.Type != "PRIVATE KEY" {
+		t.Errorf("rewritten key %q", mustRead(t, path))
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("temporary files left: %v", entries)
+	}
+}
+
+func mustRead(t *testing.T, path string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// rawAttributesSET is a relative distinguished name with its values left
+// encoded. The SET suffix makes encoding/asn1 expect a SET.
+type rawAttributesSET []struct {
+	Type  asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+func TestParseSubjectEmailIsIA5String(t *testing.T) {
+	name, err := parseSubject("CN=alice,EMAIL=alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: name}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rdns []rawAttributesSET
+	if _, err := asn1.Unmarshal(csr.RawSubject, &rdns); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, rdn := range rdns {
+		for _, atv := range rdn {
+			if atv.Type.Equal(emailAddressOID) {
+				found = true
+				if atv.Value.Tag != asn1.TagIA5String || string(atv.Value.Bytes) != "alice@example.com" {
+					t.Errorf("emailAddress encoded with tag %d: %q", atv.Value.Tag, atv.Value.Bytes)
+				}
+			}
+		}
+	}
+	if !found {
+		t.Fatal("no emailAddress in the subject")
+	}
+
+	if _, err := parseSubject("EMAIL=alicé@example.com"); err == nil {
+		t.Error("non-ASCII e-mail address accepted")
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server log levels, from most to least verbose
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// Privacy levels for the server log:
+//
+//	full     - IP addresses and client certificate bodies (debug level)
+//	standard - IP addresses, no certificate bodies
+//	strict   - salted IP address hashes, no certificate bodies
+//
+// Chat message content is never logged at any level.
+const (
+	privacyFull     = "full"
+	privacyStandard = "standard"
+	privacyStrict   = "strict"
+)
+
+// eventLogger writes structured server events as logfmt or JSON lines.
+type eventLogger struct {
+	mu      sync.Mutex
+	level   logLevel
+	format  string
+	privacy string
+	write   func(level logLevel, line string)
+	salt    []byte
+}
+
+var logger = &eventLogger{
+	level:   levelInfo,
+	format:  "logfmt",
+	privacy: privacyStandard,
+	write:   writerSink(os.Stderr),
+}
+
+func writerSink(w io.Writer) func(logLevel, string) {
+	return func(_ logLevel, line string) {
+		io.WriteString(w, line+"\n")
+	}
+}
+
+// configureLogger applies the -loglevel, -logformat, -logprivacy and
+// -logout settings.
+func configureLogger(level, format, privacy, output string) error {
+	lvl, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	if err := checkLogFormat(format); err != nil {
+		return err
+	}
+	if err := checkLogPrivacy(privacy); err != nil {
+		return err
+	}
+
+	var write func(logLevel, string)
+	switch output {
+	case "stderr":
+		write = writerSink(os.Stderr)
+	case "stdout":
+		write = writerSink(os.Stdout)
+	case "syslog":
+		var err error
+		if write, err = syslogSink(); err != nil {
+			return err
+		}
+	default:
+		file, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		write = writerSink(file)
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+
+	logger.level = lvl
+	logger.format = format
+	logger.privacy = privacy
+	logger.write = write
+	logger.salt = salt
+	return nil
+}
+
+func parseLogLevel(level string) (logLevel, error) {
+	for i, name := range levelNames {
+		if name == level {
+			return logLevel(i), nil
+		}
+	}
+	return 0, errors.New("unknown log level: " + level)
+}
+
+func checkLogFormat(format string) error {
+	if format != "logfmt" && format != "json" {
+		return errors.New("unknown log format: " + format)
+	}
+	return nil
+}
+
+func checkLogPrivacy(privacy string) error {
+	if privacy != privacyFull && privacy != privacyStandard && privacy != privacyStrict {
+		return errors.New("unknown log privacy level: " + privacy)
+	}
+	return nil
+}
+
+// log records an event with key/value pair fields if level is enabled.
+func (l *eventLogger) log(level logLevel, msg string, fields ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if level < l.level {
+		return
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	if l.format == "json" {
+		record := map[string]interface{}{"time": now, "level": levelNames[level], "msg": msg}
+		for i := 0; i+1 < len(fields); i += 2 {
+			record[fmt.Sprint(fields[i])] = fmt.Sprint(fields[i+1])
+		}
+		line, _ := json.Marshal(record)
+		l.write(level, string(line))
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "time=%s level=%s msg=%s", now, levelNames[level], logfmtValue(msg))
+	for i := 0; i+1 < len(fields); i += 2 {
+		fmt.Fprintf(&b, " %s=%s", fields[i], logfmtValue(fmt.Sprint(fields[i+1])))
+	}
+	l.write(level, b.String())
+}
+
+func logfmtValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " \"=\n\t") {
+		return fmt.Sprintf("%q", value)
+	}
+	return value
+}
+
+func logDebug(msg string, fields ...interface{}) { logger.log(levelDebug, msg, fields...) }
+func logInfo(msg string, fields ...interface{})  { logger.log(levelInfo, msg, fields...) }
+func logWarn(msg string, fields ...interface{})  { logger.log(levelWarn, msg, fields...) }
+func logError(msg string, fields ...interface{}) { logger.log(levelError, msg, fields...) }
+
+// logAddr renders a client address for the log according to the privacy
+// level.
+func logAddr(addr net.Addr) string {
+	logger.mu.Lock()
+	privacy, salt := logger.privacy, logger.salt
+	logger.mu.Unlock()
+
+	if privacy != privacyStrict {
+		return addr.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	hash := sha256.New()
+	hash.Write(salt)
+	hash.Write([]byte(host))
+	return "ip-" + hex.EncodeToString(hash.Sum(nil))[:16]
+}
+
+// logCertificates reports whether certificate bodies may be logged.
+func logCertificates() bool {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+
+	return logger.privacy == privacyFull
+}
@@ -0,0 +1,9 @@
+//go:build windows || plan9
+
+package main
+
+import "errors"
+
+func syslogSink() (func(logLevel, string), error) {
+	return nil, errors.New("syslog output is not supported on this platform")
+}
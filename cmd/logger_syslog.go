@@ -0,0 +1,26 @@
+//go:build !windows && !plan9
+
+package main
+
+import "log/syslog"
+
+// syslogSink sends log lines to the local syslog daemon, which journald
+// also collects.
+func syslogSink() (func(logLevel, string), error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "ircs")
+	if err != nil {
+		return nil, err
+	}
+	return func(level logLevel, line string) {
+		switch level {
+		case levelDebug:
+			w.Debug(line)
+		case levelInfo:
+			w.Info(line)
+		case levelWarn:
+			w.Warning(line)
+		default:
+			w.Err(line)
+		}
+	}, nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// chatSession is a client connected to handleClient through net.Pipe.
+type chatSession struct {
+	t     *testing.T
+	conn  *tls.Conn
+	lines chan string
+	done  chan struct{}
+}
+
+// setTestServer makes a new certificate the server certificate for a test,
+// and returns it for connectSession.
+func setTestServer(t *testing.T) tls.Certificate {
+	t.Helper()
+	serverX509, serverKey := newTestCert(t, testCert{subject: "localhost"})
+	pkiMu.Lock()
+	saved := serverCert
+	serverCert = serverX509
+	pkiMu.Unlock()
+	t.Cleanup(func() {
+		pkiMu.Lock()
+		serverCert = saved
+		pkiMu.Unlock()
+	})
+	return tls.Certificate{Certificate: [][]byte{serverX509.Raw}, PrivateKey: serverKey, Leaf: serverX509}
+}
+
+// connectSession runs handleClient for a new client certificate with the
+// given common name.
+func connectSession(t *testing.T, server tls.Certificate, name string) *chatSession {
+	t.Helper()
+	return connectCert(t, server, testCert{subject: name})
+}
+
+// connectCert runs handleClient for a new client certificate.
+func connectCert(t *testing.T, server tls.Certificate, c testCert) *chatSession {
+	t.Helper()
+	cert, key := newTestCert(t, c)
+	serverSide, clientSide := net.Pipe()
+
+	s := &chatSession{
+		t:     t,
+		lines: make(chan string, 100),
+		done:  make(chan struct{}),
+	}
+	go func() {
+		defer close(s.done)
+		handleClient(tls.Server(serverSide, &tls.Config{
+			Certificates: []tls.Certificate{server},
+			ClientAuth:   tls.RequireAnyClientCert,
+		}))
+	}()
+	s.conn = tls.Client(clientSide, &tls.Config{
+		Certificates:       []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}},
+		InsecureSkipVerify: true,
+	})
+	go func() {
+		defer close(s.lines)
+		scanner := bufio.NewScanner(s.conn)
+		for scanner.Scan() {
+			s.lines <- scanner.Text()
+		}
+	}()
+	t.Cleanup(func() { s.conn.Close() })
+	return s
+}
+
+func (s *chatSession) send(line string) {
+	s.t.Helper()
+	if _, err := fmt.Fprintln(s.conn, line); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+// expect waits for a line containing want.
+func (s *chatSession) expect(want string) {
+	s.t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case line, ok := <-s.lines:
+			if !ok {
+				s.t.Fatalf("connection closed waiting for %q", want)
+			}
+			if strings.Contains(line, want) {
+				return
+			}
+		case <-timeout:
+			s.t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+}
+
+// quit ends the session and waits for the server to forget it.
+func (s *chatSession) quit() {
+	s.send("QUIT")
+	select {
+	case <-s.done:
+	case <-time.After(5 * time.Second):
+		s.t.Fatal("server did not end the session")
+	}
+}
+
+// captureLog sends the event log and the audit log to buffers for the
+// duration of a test.
+func captureLog(t *testing.T, level logLevel, format, privacy string) *bytes.Buffer {
+	var mu sync.Mutex
+	var buf bytes.Buffer
+
+	logger.mu.Lock()
+	level0, format0, privacy0 := logger.level, logger.format, logger.privacy
+	salt0, write0 := logger.salt, logger.write
+	logger.level, logger.format, logger.privacy = level, format, privacy
+	logger.salt = []byte("test salt")
+	logger.write = func(_ logLevel, line string) {
+		mu.Lock()
+		defer mu.Unlock()
+		buf.WriteString(line + "\n")
+	}
+	logger.mu.Unlock()
+
+	audit.mu.Lock()
+	savedOut := audit.out
+	audit.out = writerFunc(func(p []byte) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return buf.Write(p)
+	})
+	audit.mu.Unlock()
+
+	t.Cleanup(func() {
+		logger.mu.Lock()
+		logger.level, logger.format, logger.privacy = level0, format0, privacy0
+		logger.salt, logger.write = salt0, write0
+		logger.mu.Unlock()
+		audit.mu.Lock()
+		audit.out = savedOut
+		audit.mu.Unlock()
+	})
+	return &buf
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+func TestLogOmitsMessageContent(t *testing.T) {
+	server := setTestServer(t)
+
+	for _, privacy := range []string{privacyFull, privacyStandard, privacyStrict} {
+		for _, format := range []string{"logfmt", "json"} {
+			t.Run(privacy+"/"+format, func(t *testing.T) {
+				buf := captureLog(t, levelDebug, format, privacy)
+				alice := connectSession(t, server, "alice-"+privacy+format)
+				bob := connectSession(t, server, "bob-"+privacy+format)
+				room := "#secret-" + privacy + format
+
+				alice.send("JOIN " + room)
+				alice.expect("Joined room")
+				bob.send("JOIN " + room)
+				bob.expect("Joined room")
+				alice.send("attack at dawn")
+				bob.expect("attack at dawn")
+				bob.send("MSG " + room + " bring the password hunter2")
+				alice.expect("hunter2")
+				alice.send("WHOIS @bob-" + privacy + format)
+				alice.expect("Identity of")
+				alice.quit()
+				bob.quit()
+
+				log := buf.String()
+				if !strings.Contains(log, "client joined") || !strings.Contains(log, "client left") {
+					t.Fatalf("traffic was not logged at all:\n%s", log)
+				}
+				for _, body := range []string{"attack at dawn", "hunter2", "bring the password"} {
+					if strings.Contains(log, body) {
+						t.Errorf("log contains message content %q:\n%s", body, log)
+					}
+				}
+				if logged := strings.Contains(log, "BEGIN CERTIFICATE"); logged != (privacy == privacyFull) {
+					t.Errorf("certificate bodies logged = %v at privacy %s", logged, privacy)
+				}
+			})
+		}
+	}
+}
+
+func TestLogAddrPrivacy(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.7"), Port: 4242}
+	for _, privacy := range []string{privacyFull, privacyStandard, privacyStrict} {
+		captureLog(t, levelDebug, "logfmt", privacy)
+		got := logAddr(addr)
+		if hidden := !strings.Contains(got, "192.0.2.7"); hidden != (privacy == privacyStrict) {
+			t.Errorf("privacy %s logs the address as %q", privacy, got)
+		}
+	}
+}
@@ -10,50 +10,62 @@ import (
 	"encoding/pem"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/pedroalbanese/readline"
 	"github.com/pedroalbanese/color"
 )
 
-type Client struct {
-	conn        net.Conn
-	username    string
-	clientCert  *x509.Certificate
-	room        *Room
-}
-
-type Room struct {
-	name    string
-	clients []*Client
-	mu      sync.Mutex
-}
-
-var (
-	clientSKIDs   map[string]bool
-	clientSKIDsMu sync.Mutex
-)
-
-var clients []Client
-var rooms []*Room
-
 // OID for Subject Key Identifier extension
 var subjectKeyIdentifierOID = asn1.ObjectIdentifier{2, 5, 29, 14}
 var authorityKeyIdentifierOID = []int{2, 5, 29, 35}
 
 var (
+	adminSock  = flag.String("admin", "", "Admin control socket path. (server)")
+	caDir      = flag.String("cadir", "", "CA directory for certificate enrollment. (server)")
+	caPass     = flag.String("capwd", "", "Password of the CA private key. (server)")
 	certFile   = flag.String("cert", "", "Certificate file path.")
+	clientCA   = flag.String("clientca", "", "CA certificates that client certificates are verified against. (server)")
+	auditFile  = flag.String("audit", "", "Audit log file. (default stderr)")
+	auditSign  = flag.Bool("auditsign", false, "Sign audit records with the server key.")
+	configFile = flag.String("config", "", "Configuration file. (TOML)")
+	contactDB  = flag.String("contacts", "", "Contact file of known peer keys. (client, default next to -cert)")
 	crlFile    = flag.String("crl", "", "Certificate revcation list.")
-	keyFile    = flag.String("key", "", "Private key file path.")
+	enrollTok  = flag.String("enrolltoken", "", "Single-use tokens required to request a certificate. (comma-separated, server)")
+	identMap   = flag.String("identity", "cn", "Identity attribute or template: <cn|uid|email|upn|serial|o|ou>")
+	keyFile    = flag.String("key", "", "Private key file path, pkcs11: URI or agent:<socket>.")
+	keyIDAlg   = flag.String("keyid", "skid", "Key identifier: <skid|sha256|streebog|rfc7093-1|rfc7093-2|rfc7093-3>")
+	listenAddr = flag.String("listen", "localhost:8000", "Listen address. (server)")
+	logFormat  = flag.String("logformat", "logfmt", "Server log format: <logfmt|json>")
+	logLvl     = flag.String("loglevel", "info", "Server log level: <debug|info|warn|error>")
+	logOutput  = flag.String("logout", "stderr", "Server log output: <stderr|stdout|syslog|file path>")
+	logPrivacy = flag.String("logprivacy", "standard", "Server log privacy: <full|standard|strict>")
+	metricAddr = flag.String("metrics", "", "Prometheus metrics listen address, e.g. localhost:9100. (server)")
 	mode       = flag.String("mode", "client", "Mode: <server|client>")
+	nickPolicy = flag.String("nick", "off", "NICK command policy: <off|free|registry>")
+	nickFile   = flag.String("nickreg", "", "Nickname registry file. (key ID or identity and nick per line)")
+	opers      = flag.String("opers", "", "Server operators: key IDs, identities, subject:<DN>, policy:<OID> or eku:<OID>. (comma-separated)")
+	plainUI    = flag.Bool("plain", false, "Line by line client instead of the full-screen interface.")
+	keyPass    = flag.String("pwd", "", "Password. (for Private key PEM decryption)")
+	rateLimit  = flag.Int("ratelimit", 0, "Lines per second accepted from each session, 0 for no limit. (server)")
+	roomCreate = flag.String("roomcreate", "any", "Who may create rooms by joining them: <any|opers> (server)")
+	permRooms  = flag.String("rooms", "", "Rooms that always exist, even when empty. (comma-separated, server)")
+	roomSize   = flag.Int("roomsize", 0, "Members per room, 0 for no limit. (server)")
 	serverAddr = flag.String("ipport", "localhost:8000", "Server address.")
+	sessionPol = flag.String("sessions", "reject", "Sessions per certificate: <reject|replace|N>")
 	strict     = flag.Bool("strict", false, "Restrict users.")
+	tlsCiphers = flag.String("tlsciphers", "", "TLS cipher suites. (comma-separated, default from profile)")
+	tlsCurves  = flag.String("tlscurves", "", "TLS key exchange groups. (comma-separated, default from profile)")
+	tlsMaxVer  = flag.String("tlsmax", "", "Maximum TLS version: <1.0|1.1|1.2|1.3> (default from profile)")
+	tlsMinVer  = flag.String("tlsmin", "", "Minimum TLS version: <1.0|1.1|1.2|1.3> (default from profile)")
+	tlsProfile = flag.String("tlsprofile", "modern", "TLS profile: <modern|gost-only|compat>")
+	tlsSigAlgs = flag.String("tlssigalgs", "", "Signature algorithms allowed on peer certificates, not in the handshake. (comma-separated, default from profile)")
 )
 
 func init() {
@@ -61,66 +73,119 @@ func init() {
 }
 
 func main() {
-	flag.Parse()
+	// Subcommands are dispatched before the chat flags are parsed
+	if filepath.Base(os.Args[0]) == "ircsctl" {
+		ircsctl(os.Args[1:])
+		return
+	}
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "ctl":
+			ircsctl(os.Args[2:])
+			return
+		case "audit":
+			auditVerify(os.Args[2:])
+			return
+		case "check-config":
+			checkConfigCommand(os.Args[2:])
+			return
+		case "keygen":
+			keygenCommand(os.Args[2:])
+			return
+		case "req":
+			reqCommand(os.Args[2:])
+			return
+		case "key":
+			keyCommand(os.Args[2:])
+			return
+		case "agent":
+			agentCommand(os.Args[2:])
+			return
+		case "ca":
+			caCommand(os.Args[2:])
+			return
+		case "crl":
+			caCommand(append([]string{"crl"}, os.Args[2:]...))
+			return
+		}
+	}
 
-	clientSKIDs = make(map[string]bool)
+	flag.Parse()
+	if err := applyConfig(); err != nil {
+		log.Fatal(err)
+	}
 
 	if *mode == "server" {
-		// Load the server certificate and private key
-		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
-		if err != nil {
+		if err := configureLogger(*logLvl, *logFormat, *logPrivacy, *logOutput); err != nil {
 			log.Fatal(err)
 		}
 
-		var certPEM []byte
-		file, err := os.Open(*certFile)
+		// Validate the settings and load the server certificate, private key and CRL
+		err := checkConfig()
 		if err != nil {
 			log.Fatal(err)
 		}
-		info, err := file.Stat()
+
+		if *auditFile != "" {
+			if err := openAuditLog(*auditFile, *auditSign); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		replaceSessions, maxSessions, err = parseSessionPolicy(*sessionPol)
 		if err != nil {
 			log.Fatal(err)
 		}
-		buf := make([]byte, info.Size())
-		file.Read(buf)
-		certPEM = buf
-		var certPemBlock, _ = pem.Decode([]byte(certPEM))
-		var serverCert, _ = x509.ParseCertificate(certPemBlock.Bytes)
 
-		var crl *pkix.CertificateList
-		if *crlFile != "" {
-		// Load the CRL from a file
-			crlFile, err := os.Open(*crlFile)
+		if *nickFile != "" {
+			nickRegistry, err = loadNickRegistry(*nickFile)
 			if err != nil {
-			    log.Fatal(err)
-			}
-			defer crlFile.Close()
-
-			// Decode the PEM block of the CRL
-			crlBytes, err := ioutil.ReadAll(crlFile)
-			if err != nil {
-			    log.Fatal(err)
-			}
-			crl, err = x509.ParseCRL(crlBytes)
-			if err != nil {
-			    log.Fatal(err)
+				log.Fatal(err)
 			}
 		}
 
+		policy, err := newTLSPolicy()
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Any certificate may connect, since unknown users can enroll;
+		// strict mode, operators and registered nicknames are decided
+		// against the client CAs after the handshake
 		config := &tls.Config{
-			Certificates: []tls.Certificate{cert},
-			ClientAuth:   tls.RequireAnyClientCert,
-			MinVersion:   tls.VersionTLS13,
-			MaxVersion:   tls.VersionTLS13,
+			GetCertificate: getServerCertificate,
+			ClientAuth:     tls.RequireAnyClientCert,
+			ClientCAs:      currentClientCAs(),
+		}
+		if config.ClientCAs == nil && (*strict || *opers != "" || *nickFile != "") {
+			logWarn("no client CAs: -strict falls back to comparing AKIDs, and -opers and -nickreg only match spki: entries or key IDs computed from the key")
 		}
+		policy.apply(config)
+		logInfo("TLS policy", policy.report()...)
+		if err := policy.checkLocalCertificate(currentServerCert()); err != nil {
+			log.Fatal(err)
+		}
+		pkiMu.Lock()
+		serverPolicy = policy
+		pkiMu.Unlock()
+		openPermanentRooms()
 
-		listener, err := tls.Listen("tcp", "localhost:8000", config)
+		listener, err := tls.Listen("tcp", *listenAddr, config)
 		if err != nil {
 			log.Fatal(err)
 		}
 		defer listener.Close()
 
-		fmt.Println("Chat server started. Waiting for TLS connections...")
+		if *metricAddr != "" {
+			startMetrics(*metricAddr)
+		}
+
+		if *adminSock != "" {
+			if err := startAdminSocket(*adminSock); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		logInfo("chat server started, waiting for TLS connections")
 
 		for {
 			conn, err := listener.Accept()
@@ -128,8 +193,7 @@ func main() {
 				log.Fatal(err)
 			}
 
-//			go handleClient(conn)
-			go handleClient(conn, serverCert, crl)
+			go handleClient(conn)
 		}
 	} else {
 		if *certFile == "" || *keyFile == "" {
@@ -137,16 +201,32 @@ func main() {
 		}
 
 		// Load client certificate and key
-		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		cert, err := loadKeyPair(*certFile, *keyFile, []byte(*keyPass))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		contacts, err := loadContacts(contactsPath(), cert.Leaf.RawSubjectPublicKeyInfo)
 		if err != nil {
 			log.Fatal(err)
 		}
 
+		policy, err := newTLSPolicy()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			log.Fatal(err)
+		} else if err := policy.checkLocalCertificate(leaf); err != nil {
+			log.Fatal(err)
+		}
+
 		// Configure TLS connection
 		config := &tls.Config{
 			Certificates:       []tls.Certificate{cert},
 			InsecureSkipVerify: true,
 		}
+		policy.apply(config)
 
 		// Connect to the server
 		conn, err := tls.Dial("tcp", *serverAddr, config)
@@ -167,6 +247,7 @@ func main() {
 		}
 
 		log.Println("Connected to server")
+		log.Println("Negotiated", describeConnection(state))
 
 		// Read user input from stdin
 		reader := bufio.NewReader(os.Stdin)
@@ -183,8 +264,16 @@ func main() {
 			conn: conn,
 		}
 
+		if useTUI() {
+			if err := runTUI(client, cert, contacts, state); err != nil {
+				log.Fatal(err)
+			}
+			log.Println("Disconnected from server")
+			return
+		}
+
 		// Start reading messages from the server in a separate goroutine
-		go readMessages(client)
+		go readMessages(client, contacts, consoleUI{})
 
 		// Read user input and send messages to the server
 		for {
@@ -195,15 +284,19 @@ func main() {
 				break
 			}
 
-			rl, err := readline.New("")
-			if err != nil {
-				fmt.Println("Erro ao criar o leitor de linha:", err)
-				os.Exit(1)
+			// Replace the typed line with its timestamped echo
+			fmt.Fprint(color.Output, "\033[1A\033[K")
+			echo := message
+			if strings.HasPrefix(message, "MSG ") {
+				if parts := strings.SplitN(strings.TrimPrefix(message, "MSG "), " ", 2); len(parts) == 2 {
+					echo = "[" + parts[0] + "] " + parts[1]
+				}
+			}
+			printMessageln(echo)
+			message, ok := clientCommand(message, cert, contacts, consoleUI{})
+			if !ok {
+				continue
 			}
-			defer rl.Close()
-			
-			rl.Stdout().Write([]byte("\033[1A\033[K"))
-			printMessageln(message)
 			_, err = conn.Write([]byte(message + "\n"))
 			if err != nil {
 				log.Println("Error sending message:", err)
@@ -215,8 +308,45 @@ func main() {
 	}
 }
 
-// readMessages reads messages from the server and prints them to the console
-func readMessages(client *Client) {
+// clientUI shows what the client receives and has to say.
+type clientUI interface {
+	show(message string)   // a line from the server
+	notify(message string) // a line from the client itself
+	warn(message string)   // a line the user must not miss
+}
+
+// consoleUI prints line by line to the console.
+type consoleUI struct{}
+
+func (consoleUI) show(message string)   { printMessage(message) }
+func (consoleUI) notify(message string) { printMessageln(message) }
+func (consoleUI) warn(message string)   { printWarning(message) }
+
+// clientCommand handles the commands the client answers itself and
+// returns the line to send to the server, if any.
+func clientCommand(message string, cert tls.Certificate, contacts *contactStore, ui clientUI) (string, bool) {
+	var err error
+	if message == "CONTACTS" {
+		for _, line := range contacts.list() {
+			ui.notify(line)
+		}
+		return "", false
+	} else if strings.HasPrefix(message, "SAFETY ") || strings.HasPrefix(message, "VERIFY ") {
+		// Look the key up; readMessages completes the command
+		action, nick, _ := strings.Cut(message, " ")
+		message = contacts.request(strings.TrimSpace(nick), strings.ToLower(action))
+	} else if message == "ENROLL" || strings.HasPrefix(message, "ENROLL ") {
+		// Request a certificate for our key from the server's CA
+		if message, err = enrollRequest(cert, strings.TrimSpace(strings.TrimPrefix(message, "ENROLL"))); err != nil {
+			log.Println("Error creating enrollment request:", err)
+			return "", false
+		}
+	}
+	return message, true
+}
+
+// readMessages reads messages from the server and shows them
+func readMessages(client *Client, contacts *contactStore, ui clientUI) {
 	reader := bufio.NewReader(client.conn)
 
 	for {
@@ -226,18 +356,45 @@ func readMessages(client *Client) {
 			break
 		}
 
+		if strings.HasPrefix(message, "CERTIFICATE ") {
+			path, err := saveIssuedCertificate(strings.TrimSpace(strings.TrimPrefix(message, "CERTIFICATE ")))
+			if err != nil {
+				log.Println("Error saving issued certificate:", err)
+			} else {
+				log.Println("Certificate issued and saved to", path+". Reconnect with -cert", path)
+			}
+			continue
+		}
+
+		if strings.HasPrefix(message, "KEY ") {
+			for _, note := range contacts.observe(message) {
+				if strings.HasPrefix(note, "WARNING") {
+					ui.warn(note)
+				} else {
+					ui.notify(note)
+				}
+			}
+			continue
+		}
+
 //		fmt.Print(message)
-		printMessage(message)
+		ui.show(message)
+
+		// Check the keys of users we have not seen yet in this session
+		for _, name := range messageSender(message) {
+			if request := contacts.lookup(name); request != "" {
+				client.conn.Write([]byte(request + "\n"))
+			}
+		}
 	}
 
 	log.Println("Disconnected from server")
 }
 
-//func handleClient(conn net.Conn) {
-func handleClient(conn net.Conn, serverCert *x509.Certificate, CRLFile *pkix.CertificateList) {
+func handleClient(conn net.Conn) {
 	tlsConn, ok := conn.(*tls.Conn)
 	if !ok {
-		log.Println("Connection is not a TLS connection.")
+		logWarn("connection is not a TLS connection", "ip", logAddr(conn.RemoteAddr()))
 		conn.Close()
 		return
 	}
@@ -245,100 +402,127 @@ func handleClient(conn net.Conn, serverCert *x509.Certificate, CRLFile *pkix.Cer
 	// Verify the client certificate
 	err := tlsConn.Handshake()
 	if err != nil {
-		log.Println("Failed to perform TLS handshake:", err)
+		logWarn("TLS handshake failed", "ip", logAddr(conn.RemoteAddr()), "error", err)
+		countHandshakeFailure(failTLS)
+		auditAuth("refuse", nil, "reason", failTLS, "ip", logAddr(conn.RemoteAddr()))
 		conn.Close()
 		return
 	}
 
 	state := tlsConn.ConnectionState()
 	if len(state.PeerCertificates) == 0 {
-		log.Println("Client certificate is missing.")
+		logWarn("client certificate is missing", "ip", logAddr(conn.RemoteAddr()))
+		countHandshakeFailure(failNoCert)
+		auditAuth("refuse", nil, "reason", failNoCert, "ip", logAddr(conn.RemoteAddr()))
 		conn.Close()
 		return
 	}
 
 	clientCert := state.PeerCertificates[0]
 
-	skid := getClientSKID(clientCert)
-
-	// Check if the SKID is already registered
-	clientSKIDsMu.Lock()
-	if _, exists := clientSKIDs[skid]; exists {
-		log.Println("Client already logged in.")
-		message := "You are already logged in from another session."
-		_, err := conn.Write([]byte(message + "\n"))
-		if err != nil {
-			log.Println("Error sending message to client:", err)
-		}
-		conn.Close()
-		clientSKIDsMu.Unlock()
-		return
-	}
-	clientSKIDs[skid] = true
-	clientSKIDsMu.Unlock()
+	keyID := clientKeyID(clientCert)
+	verified := verifyClientChain(state.PeerCertificates)
 
 	if *strict {
-		clientSKIDsMu.Lock()
-		if !bytes.Equal(clientCert.AuthorityKeyId, serverCert.AuthorityKeyId) {
-			message := "Invalid client certificate."
-			_, err := conn.Write([]byte(message + "\n"))
-			if err != nil {
-				log.Println("Error sending message to client:", err)
+		trusted := verified
+		if currentClientCAs() == nil {
+			trusted = bytes.Equal(clientCert.AuthorityKeyId, currentServerCert().AuthorityKeyId)
+		}
+		if !trusted {
+			// With a CA, unknown certificates may enroll for a new one
+			if _, banned := banReason(keyID); serverCA != nil && !banned && isCertificateValid(clientCert) {
+				enrollSession(conn, clientCert, keyID)
+				return
 			}
-			conn.Close()
-			delete(clientSKIDs, skid)
-			clientSKIDsMu.Unlock()
+			refuseClient(conn, clientCert, failAKID, keyID, "Invalid client certificate.")
 			return
 		}
-		clientSKIDs[skid] = true
-		clientSKIDsMu.Unlock()
 	}
 
-	if *crlFile != "" {
-		revoked, revocationTime := isCertificateRevoked(clientCert, CRLFile)
-		if revoked {
-			message := "Your certificate has been revoked. Please contact the certificate authority.\nRevocation Time: " + revocationTime.String()
-			_, err := conn.Write([]byte(message + "\n"))
-			if err != nil {
-				log.Println("Error sending message to client:", err)
-			}
-			conn.Close()
-			delete(clientSKIDs, skid)
-			return
-		}
+	if revoked, revocationTime := revocationStatus(clientCert); revoked {
+		refuseClient(conn, clientCert, failRevoked, keyID, "Your certificate has been revoked. Please contact the certificate authority.\nRevocation Time: "+revocationTime.String())
+		return
 	}
 
 	if isCertificateValid(clientCert) == false {
-		message := "Your certificate has been expired."
-		_, err := conn.Write([]byte(message + "\n"))
-		if err != nil {
-			log.Println("Error sending message to client:", err)
-		}
-		conn.Close()
-		delete(clientSKIDs, skid)
+		refuseClient(conn, clientCert, failExpired, keyID, "Your certificate has been expired.")
+		return
+	}
+
+	if reason, banned := banReason(keyID); banned {
+		refuseClient(conn, clientCert, failBanned, keyID, "You are banned from this server: "+reason)
 		return
 	}
 
-	// Extract the username from the client certificate
-//	username := strings.TrimPrefix(clientCert.Subject.CommonName, "CN=")
-	username := "@" + strings.TrimPrefix(clientCert.Subject.CommonName, "CN=")
+	// Extract the identity from the client certificate
+	identity, err := mapIdentity(clientCert, *identMap)
+	if err != nil {
+		logDebug("identity mapping failed", "keyid", keyID, "error", err)
+		refuseClient(conn, clientCert, failIdentity, keyID, "Your certificate does not carry the required identity attribute.")
+		return
+	}
+
+	client := newClient(conn, "@"+sanitizeNick(identity), clientCert, keyID)
+	client.identity = identity
+	client.verified = verified
+	if nicks := registeredNicks(client); len(nicks) > 0 {
+		client.username = "@" + nicks[0]
+	}
+	client.oper = isOperator(client)
+	if client.oper {
+		auditOper(client.name(), "login", "keyid", keyID, "ip", logAddr(conn.RemoteAddr()))
+	}
 
-	client := Client{
-		conn:        conn,
-		username:    username,
-		clientCert:  clientCert,
+	if replaceSessions {
+		for _, old := range hub.sessionsOf(keyID) {
+			// Only the holder of the same certificate key may take over
+			if !sameHolder(old, client) {
+				break
+			}
+			old.send("Your session was replaced by a new login.\n")
+			hub.unregister(old)
+			auditAuth("replace", clientCert, "keyid", keyID, "session", strconv.FormatUint(old.id, 10))
+		}
 	}
 
+	// Check if the key ID is already registered
+	if err := hub.register(client, maxSessions); err != nil {
+		message := "You are already logged in from another session."
+		switch {
+		case err == errKeyIDClash:
+			message = "Another certificate is logged in with the same key ID."
+		case maxSessions > 1:
+			message = fmt.Sprintf("You already have %d sessions open.", maxSessions)
+		}
+		refuseClient(conn, clientCert, failDuplicate, keyID, message)
+		return
+	}
+	go client.writeLoop()
+	atomic.AddUint64(&handshakeSuccesses, 1)
+	auditAuth("admit", clientCert, "user", client.name(), "identity", identity, "keyid", keyID,
+		"session", strconv.FormatUint(client.id, 10), "ip", logAddr(conn.RemoteAddr()))
+
 //	message := fmt.Sprintf("%s joined the chat", client.username)
-	message := fmt.Sprintf("%s joined the chat at %s", client.username, time.Now().Format("2006-01-02 15:04:05"))
-	fmt.Println(message)
-	fmt.Println("SKID:", getClientSKID(client.clientCert))
-	fmt.Println("AKID:", getClientAKID(client.clientCert))
-	fmt.Println("IP Address:", conn.RemoteAddr())
-	fmt.Println("Certificate:")
-	printClientCertPEM(client.clientCert)
-	broadcastMessage(message)
+	message := fmt.Sprintf("%s joined the chat at %s", client.name(), time.Now().Format("2006-01-02 15:04:05"))
+	logInfo("client joined", "user", client.name(), "session", client.id, "keyid", client.keyID, "keyid_method", *keyIDAlg,
+		"skid", getClientSKID(clientCert), "akid", getClientAKID(clientCert), "ip", logAddr(conn.RemoteAddr()),
+		"tls", versionName(state.Version), "cipher", cipherSuiteName(state.CipherSuite))
+	if logCertificates() {
+		logDebug("client certificate", "user", client.name(), "pem", clientCertPEM(clientCert))
+	}
+
+	deliverCertificate(keyID)
+
+	// Additional sessions share the rooms of the existing ones
+	if sessions := hub.sessionsOf(keyID); len(sessions) > 1 {
+		for _, room := range sessions[0].joinedRooms() {
+			joinRoom(client, room)
+		}
+	} else {
+		hub.notice(message + "\n")
+	}
 
+	limiter := &rateLimiter{limit: *rateLimit}
 	reader := bufio.NewReader(conn)
 	for {
 		message, err := reader.ReadString('\n')
@@ -347,48 +531,119 @@ func handleClient(conn net.Conn, serverCert *x509.Certificate, CRLFile *pkix.Cer
 		}
 		message = strings.TrimSpace(message)
 
-		if client.room == nil {
-			if strings.HasPrefix(message, "JOIN ") {
-				roomName := strings.TrimPrefix(message, "JOIN ")
-				room := findOrCreateRoom(roomName)
-				joinRoom(&client, room)
+		if !limiter.allow() {
+			client.send("You are sending too fast, line dropped.\n")
+			continue
+		}
+
+		if handleOperCommand(client, message) {
+			continue
+		} else if strings.HasPrefix(message, "JOIN ") {
+			roomName := strings.TrimSpace(strings.TrimPrefix(message, "JOIN "))
+			if !enterRoom(client, roomName) {
+				client.send("Only operators can create rooms.\n")
+			}
+		} else if message == "LEAVE" || strings.HasPrefix(message, "LEAVE ") {
+			room := currentRoom(client)
+			if roomName := strings.TrimSpace(strings.TrimPrefix(message, "LEAVE")); roomName != "" {
+				room = findClientRoom(client, roomName)
+			}
+			if room == nil {
+				client.send("You are not in that room.\n")
+				continue
+			}
+			for _, session := range hub.sessionsOf(client.keyID) {
+				leaveRoom(session, room)
+			}
+		} else if strings.HasPrefix(message, "QUIT") {
+			break
+		} else if message == "LIST" || strings.HasPrefix(message, "LIST ") || message == "NAMES" || strings.HasPrefix(message, "NAMES ") {
+			var response string
+			roomName := strings.TrimSpace(strings.TrimPrefix(strings.TrimPrefix(message, "LIST"), "NAMES"))
+			if roomName != "" {
+				room := hub.findRoom(roomName)
+				if room == nil {
+					client.send("No such room: " + roomName + "\n")
+					continue
+				}
+				response = listUsers(room)
+			} else if room := currentRoom(client); room != nil {
+				response = listUsers(room)
 			} else {
-				conn.Write([]byte("You are not in a room. Use JOIN <room> command to join a room.\n"))
+				response = listRooms()
 			}
-		} else {
-			if strings.HasPrefix(message, "JOIN ") {
-				leaveRoom(&client)
-				roomName := strings.TrimPrefix(message, "JOIN ")
-				room := findOrCreateRoom(roomName)
-				joinRoom(&client, room)
-			} else if strings.HasPrefix(message, "LEAVE") {
-				leaveRoom(&client)
-			} else if strings.HasPrefix(message, "QUIT") {
-				conn.Close()
-				removeClient(&client)
-				break 
-			} else if strings.TrimSpace(message) == "LIST" {
-				response := listUsers(client.room)
-				_, err := client.conn.Write([]byte(response))
-				if err != nil {
-					log.Println("Error sending user list:", err)
+			client.send(response)
+			continue
+		} else if strings.HasPrefix(message, "MSG ") {
+			// MSG <room> <text> sends to a specific joined room
+			parts := strings.SplitN(strings.TrimPrefix(message, "MSG "), " ", 2)
+			room := findClientRoom(client, parts[0])
+			if room == nil {
+				client.send("You are not in room " + parts[0] + ". Use JOIN <room> command to join it.\n")
+				continue
+			}
+			if len(parts) == 2 {
+				sendMessage(client, room, parts[1])
+			}
+		} else if strings.HasPrefix(message, "NICK ") {
+			nick := sanitizeNick(strings.TrimPrefix(message, "NICK "))
+			if err := checkNickPolicy(client, nick); err != nil {
+				client.send("Cannot change nickname: " + err.Error() + ".\n")
+				continue
+			}
+			oldName := client.name()
+			if err := hub.rename(client, "@"+nick); err != nil {
+				client.send("Cannot change nickname: " + err.Error() + ".\n")
+				continue
+			}
+			client.send("You are now known as @" + nick + ".\n")
+			for _, room := range client.joinedRooms() {
+				for _, c := range room.members() {
+					if c != client {
+						c.send(fmt.Sprintf("[%s] %s is now known as @%s.\n", room.name, oldName, nick))
+					}
 				}
+			}
+		} else if message == "SESSIONS" {
+			client.send(listSessions(client))
+		} else if strings.HasPrefix(message, "KILLSESSION ") {
+			id, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(message, "KILLSESSION ")), 10, 64)
+			if err != nil || !killSession(client, id) {
+				client.send("No such session.\n")
+			}
+		} else if strings.HasPrefix(message, "WHOIS ") || strings.HasPrefix(message, "CERTINFO ") {
+			_, nick, _ := strings.Cut(message, " ")
+			target := hub.findClient(strings.TrimSpace(nick))
+			if target == nil {
+				client.send("No such user.\n")
 				continue
-			} else {
-				sendMessage(&client, message)
 			}
+			client.send(whois(target))
+		} else if message == "KEYOF" {
+			client.send(keyOf(client.name(), client))
+		} else if strings.HasPrefix(message, "KEYOF ") {
+			nick := strings.TrimSpace(strings.TrimPrefix(message, "KEYOF "))
+			client.send(keyOf(nick, hub.findClient(nick)))
+		} else if strings.HasPrefix(message, "ENROLL ") {
+			client.send(submitEnrollment(client, strings.TrimPrefix(message, "ENROLL ")))
+		} else if message == "NOTICES ON" || message == "NOTICES OFF" {
+			client.setMuteNotices(message == "NOTICES OFF")
+			client.send("Join/part notices are now " + strings.ToLower(strings.TrimPrefix(message, "NOTICES ")) + ".\n")
+		} else if room := currentRoom(client); room != nil {
+			sendMessage(client, room, message)
+		} else {
+			client.send("You are not in a room. Use JOIN <room> command to join a room.\n")
 		}
 	}
 
 
 //	message = fmt.Sprintf("%s left the chat", client.username)
-	message = fmt.Sprintf("%s left the chat at %s", client.username, time.Now().Format("2006-01-02 15:04:05"))
-	fmt.Println(message)
-	broadcastMessage(message)
-
-	conn.Close()
-	delete(clientSKIDs, skid)
-	removeClient(&client)
+	message = fmt.Sprintf("%s left the chat at %s", client.name(), time.Now().Format("2006-01-02 15:04:05"))
+	logInfo("client left", "user", client.name(), "session", client.id, "keyid", keyID)
+	hub.unregister(client)
+	if len(hub.sessionsOf(keyID)) == 0 {
+		hub.notice(message + "\n")
+	}
 }
 
 
@@ -397,12 +652,13 @@ func printMessage(message string) {
 //	currentTime := time.Now().Format("15:04:05")
 //	fmt.Printf("[%s] %s", currentTime, message)
 //	fmt.Print(message)
-	if strings.HasPrefix(message, "Users in the chat") || strings.HasPrefix(message, "-") {
+	if isListMessage(message) {
 		fmt.Print(message)
 	} else {
 		currentTime := time.Now().Format("15:04:05")
 		gray := color.New(color.FgHiBlack)
 		gray.Printf("[%s] ", currentTime)
+		message = printRoomTag(message)
 		if strings.HasPrefix(message, "@") && strings.Contains(message, "#") {
 			split := strings.SplitN(message, "#", 2)
 			if split[0] != "Joined room" && split[0] != "Left room" {
@@ -427,12 +683,13 @@ func printMessageln(message string) {
 //	currentTime := time.Now().Format("15:04:05")
 //	fmt.Printf("[%s] %s\n", currentTime, message)
 //	fmt.Println(message)
-	if strings.HasPrefix(message, "Users in the chat") || strings.HasPrefix(message, "-") {
+	if isListMessage(message) {
 		fmt.Println(message)
 	} else {
 		currentTime := time.Now().Format("15:04:05")
 		gray := color.New(color.FgHiBlack)
 		gray.Printf("[%s] ", currentTime)
+		message = printRoomTag(message)
 		if strings.HasPrefix(message, "@") && strings.Contains(message, "#") {
 			split := strings.SplitN(message, "#", 2)
 			if split[0] != "Joined room" && split[0] != "Left room" {
@@ -453,6 +710,44 @@ func printMessageln(message string) {
 	}
 }
 
+// Headers of multi-line server replies, printed without a timestamp
+var listHeaders = []string{"Users in the chat", "Rooms in the chat", "Identity of", "Sessions of", "Bans on the server", "Server configuration", "-"}
+
+func isListMessage(message string) bool {
+	for _, header := range listHeaders {
+		if strings.HasPrefix(message, header) {
+			return true
+		}
+	}
+	return false
+}
+
+// printRoomTag prints the "[room] " prefix of a room message and returns
+// the rest of the line.
+func printRoomTag(message string) string {
+	if strings.HasPrefix(message, "[") {
+		if idx := strings.Index(message, "] "); idx > 0 {
+			cyan := color.New(color.FgHiCyan)
+			cyan.Print(message[:idx+2])
+			return message[idx+2:]
+		}
+	}
+	return message
+}
+
+// refuseClient tells a client why it was refused, records the reason and
+// closes the connection.
+func refuseClient(conn net.Conn, cert *x509.Certificate, reason, keyID, message string) {
+	countHandshakeFailure(reason)
+	logInfo("client refused", "reason", reason, "keyid", keyID, "ip", logAddr(conn.RemoteAddr()))
+	auditAuth("refuse", cert, "reason", reason, "keyid", keyID, "ip", logAddr(conn.RemoteAddr()))
+	_, err := conn.Write([]byte(message + "\n"))
+	if err != nil {
+		logWarn("error sending message to client", "error", err)
+	}
+	conn.Close()
+}
+
 func isCertificateRevoked(cert *x509.Certificate, crl *pkix.CertificateList) (bool, time.Time) {
 	for _, revokedCert := range crl.TBSCertList.RevokedCertificates {
 		if revokedCert.SerialNumber.Cmp(cert.SerialNumber) == 0 {
@@ -471,64 +766,136 @@ func isCertificateValid(cert *x509.Certificate) bool {
 }
 
 func listUsers(room *Room) string {
-	userList := "Users in the chat:\n"
-	for _, client := range room.clients {
-		userList += "- " + client.username + "\n"
+	userList := "Users in the chat (" + room.name + "):\n"
+	seen := make(map[string]bool)
+	for _, client := range room.members() {
+		// Sessions sharing a certificate are listed once
+		if name := client.name(); !seen[name] {
+			seen[name] = true
+			userList += "- " + name + "\n"
+		}
 	}
 	return userList
 }
 
-func findOrCreateRoom(roomName string) *Room {
-	for _, room := range rooms {
+func listRooms() string {
+	roomList := "Rooms in the chat:\n"
+	for _, room := range hub.roomList() {
+		roomList += fmt.Sprintf("- %s (%d)\n", room.name, len(room.members()))
+	}
+	return roomList
+}
+
+// currentRoom returns the room plain messages are sent to, which is the
+// most recently joined one.
+func currentRoom(client *Client) *Room {
+	rooms := client.joinedRooms()
+	if len(rooms) == 0 {
+		return nil
+	}
+	return rooms[len(rooms)-1]
+}
+
+func findClientRoom(client *Client, roomName string) *Room {
+	for _, room := range client.joinedRooms() {
 		if room.name == roomName {
 			return room
 		}
 	}
-	room := &Room{
-		name:    roomName,
-		clients: make([]*Client, 0),
-	}
-	rooms = append(rooms, room)
-	return room
+	return nil
 }
 
-func joinRoom(client *Client, room *Room) {
+// joinRoom adds the client to the room. It returns false if the room was
+// removed from the registry for being empty, and must be looked up again.
+func joinRoom(client *Client, room *Room) bool {
 	room.mu.Lock()
 	defer room.mu.Unlock()
 
-	client.room = room
-	client.room.clients = append(client.room.clients, client)
+	if room.closed {
+		return false
+	}
+	client.mu.Lock()
+	if client.closed {
+		client.mu.Unlock()
+		return true
+	}
+	// Joining a room the client is already in just makes it the current one
+	for i, r := range client.rooms {
+		if r == room {
+			client.rooms = append(client.rooms[:i], client.rooms[i+1:]...)
+			client.rooms = append(client.rooms, room)
+			client.mu.Unlock()
+			client.send(fmt.Sprintf("Current room: %s\n", room.name))
+			return true
+		}
+	}
+	if roomFull(room, client) {
+		client.mu.Unlock()
+		client.send(fmt.Sprintf("Room %s is full.\n", room.name))
+		return true
+	}
+	client.rooms = append(client.rooms, room)
+	client.mu.Unlock()
+
+	present := hasSession(room, client)
+	room.clients = append(room.clients, client)
+	atomic.AddUint64(&roomJoins, 1)
+	if room.owner == "" {
+		// The first user to join a room owns it
+		room.owner = client.keyID
+	}
 
-	client.conn.Write([]byte(fmt.Sprintf("Joined room: %s\n", room.name)))
+	client.send(fmt.Sprintf("Joined room: %s\n", room.name))
 
 	// Notificar os demais clientes da sala sobre o novo ingresso
-	notifyClientJoined(room, client)
+	if !present {
+		notifyClientJoined(room, client)
+	}
+	return true
 }
 
-func notifyClientJoined(room *Room, newClient *Client) {
-	for _, client := range room.clients {
-		if client != newClient {
-			client.conn.Write([]byte(fmt.Sprintf("%s joined the room.\n", newClient.username)))
+// hasSession reports whether another session sharing the client's
+// certificate is in the room. The room must be locked.
+func hasSession(room *Room, client *Client) bool {
+	for _, c := range room.clients {
+		if c != client && c.keyID == client.keyID {
+			return true
 		}
 	}
+	return false
 }
 
-func leaveRoom(client *Client) {
-	if client.room == nil {
-		return
+func notifyClientJoined(room *Room, newClient *Client) {
+	for _, client := range room.clients {
+		if client.keyID != newClient.keyID {
+			client.send(fmt.Sprintf("[%s] %s joined the room.\n", room.name, newClient.name()))
+		}
 	}
+}
 
-	room := client.room
+func leaveRoom(client *Client, room *Room) {
+	// Deferred first, so that it runs once the room is unlocked
+	defer hub.removeRoomIfEmpty(room)
 	room.mu.Lock()
 	defer room.mu.Unlock()
 
+	client.mu.Lock()
+	for i, r := range client.rooms {
+		if r == room {
+			client.rooms = append(client.rooms[:i], client.rooms[i+1:]...)
+			break
+		}
+	}
+	client.mu.Unlock()
+
 	for i, c := range room.clients {
 		if c == client {
 			room.clients = append(room.clients[:i], room.clients[i+1:]...)
-			client.room = nil
-			client.conn.Write([]byte(fmt.Sprintf("Left room: %s\n", room.name)))
+			client.send(fmt.Sprintf("Left room: %s\n", room.name))
 
-			notifyClientLeft(room, client)
+			if !hasSession(room, client) {
+				notifyClientLeft(room, client)
+			}
 			return
 		}
 	}
@@ -537,52 +904,50 @@ func leaveRoom(client *Client) {
 func notifyClientLeft(room *Room, client *Client) {
 	// Notify all clients in the room that a client has left
 	for _, c := range room.clients {
-		c.conn.Write([]byte(fmt.Sprintf("%s left the room.\n", client.username)))
+		c.send(fmt.Sprintf("[%s] %s left the room.\n", room.name, client.name()))
 	}
 }
 
-func sendMessage(client *Client, message string) {
-	room := client.room
+func sendMessage(client *Client, room *Room, message string) {
 	room.mu.Lock()
 	defer room.mu.Unlock()
 
 	// Send the message to all clients in the same room except the sender
 	for _, c := range room.clients {
 		if c != client {
-//			c.conn.Write([]byte(fmt.Sprintf("%s: %s\n", client.username, message)))
-			c.conn.Write([]byte(fmt.Sprintf("%s# %s\n", client.username, message)))
+//			c.send(fmt.Sprintf("%s: %s\n", client.name(), message))
+			c.send(fmt.Sprintf("[%s] %s# %s\n", room.name, client.name(), message))
+			atomic.AddUint64(&messagesRelayed, 1)
 		}
 	}
 }
 
-func broadcastMessage(message string) {
-	// Send the message to all connected clients
-	for _, client := range clients {
-		fmt.Fprintln(client.conn, message)
-	}
-}
-
 func removeClient(client *Client) {
-	// Check if the client is associated with a room
-	if client.room == nil {
-		return
-	}
-
-	// Lock the room's mutex to ensure exclusive access to the room's data
-	client.room.mu.Lock()
-	defer client.room.mu.Unlock()
+	// Remove the client from every room it is associated with
+	for _, room := range client.joinedRooms() {
+		// Lock the room's mutex to ensure exclusive access to the room's data
+		room.mu.Lock()
+
+		// Find the client in the room's client list and remove it
+		for i, c := range room.clients {
+			if c == client {
+				// Create a new slice that excludes the client to be removed
+				room.clients = append(room.clients[:i], room.clients[i+1:]...)
+				break
+			}
+		}
 
-	// Find the client in the room's client list and remove it
-	for i, c := range client.room.clients {
-		if c == client {
-			// Create a new slice that excludes the client to be removed
-			client.room.clients = append(client.room.clients[:i], client.room.clients[i+1:]...)
-			break
+		client.mu.Lock()
+		for i, r := range client.rooms {
+			if r == room {
+				client.rooms = append(client.rooms[:i], client.rooms[i+1:]...)
+				break
+			}
 		}
-	}
+		client.mu.Unlock()
 
-	// Set the client's room reference to nil
-	client.room = nil
+		room.mu.Unlock()
+	}
 }
 
 func getClientSKID(cert *x509.Certificate) string {
@@ -617,12 +982,12 @@ func getClientAKID(cert *x509.Certificate) string {
 	return ""
 }
 
-func printClientCertPEM(cert *x509.Certificate) {
-	// Print the client certificate in PEM format
+func clientCertPEM(cert *x509.Certificate) string {
+	// Encode the client certificate in PEM format
 	block := &pem.Block{
 		Type:  "CERTIFICATE",
-			Bytes: cert.Raw,
+		Bytes: cert.Raw,
 	}
 
-	fmt.Println(string(pem.EncodeToMemory(block)))
+	return string(pem.EncodeToMemory(block))
 }
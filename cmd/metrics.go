@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Handshake failure reasons reported by ircs_handshake_failures_total
+const (
+	failTLS       = "tls_error"
+	failNoCert    = "no_certificate"
+	failAKID      = "akid_mismatch"
+	failRevoked   = "revoked"
+	failExpired   = "expired"
+	failBanned    = "banned"
+	failIdentity  = "identity"
+	failDuplicate = "duplicate_session"
+)
+
+// Counters exported by the metrics listener
+var (
+	handshakeSuccesses uint64
+	messagesRelayed    uint64
+	messagesDropped    uint64
+	roomJoins          uint64
+
+	handshakeFailures   = make(map[string]uint64)
+	handshakeFailuresMu sync.Mutex
+)
+
+func countHandshakeFailure(reason string) {
+	handshakeFailuresMu.Lock()
+	defer handshakeFailuresMu.Unlock()
+
+	handshakeFailures[reason]++
+}
+
+// startMetrics serves Prometheus metrics on addr under /metrics.
+func startMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", serveMetrics)
+
+	go func() {
+		logError("metrics listener stopped", "error", http.ListenAndServe(addr, mux))
+	}()
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	clients := hub.connected()
+	var queued, maxQueued int
+	for _, client := range clients {
+		depth := len(client.out)
+		queued += depth
+		if depth > maxQueued {
+			maxQueued = depth
+		}
+	}
+	rooms := hub.roomList()
+
+	fmt.Fprintln(w, "# HELP ircs_connected_clients Connected client sessions.")
+	fmt.Fprintln(w, "# TYPE ircs_connected_clients gauge")
+	fmt.Fprintln(w, "ircs_connected_clients", len(clients))
+
+	fmt.Fprintln(w, "# HELP ircs_rooms Chat rooms.")
+	fmt.Fprintln(w, "# TYPE ircs_rooms gauge")
+	fmt.Fprintln(w, "ircs_rooms", len(rooms))
+
+	fmt.Fprintln(w, "# HELP ircs_room_members Sessions in each room.")
+	fmt.Fprintln(w, "# TYPE ircs_room_members gauge")
+	for _, room := range rooms {
+		fmt.Fprintf(w, "ircs_room_members{room=\"%s\"} %d\n", escapeLabel(room.name), len(room.members()))
+	}
+
+	fmt.Fprintln(w, "# HELP ircs_messages_total Room messages relayed to recipients.")
+	fmt.Fprintln(w, "# TYPE ircs_messages_total counter")
+	fmt.Fprintln(w, "ircs_messages_total", atomic.LoadUint64(&messagesRelayed))
+
+	fmt.Fprintln(w, "# HELP ircs_room_joins_total Room joins.")
+	fmt.Fprintln(w, "# TYPE ircs_room_joins_total counter")
+	fmt.Fprintln(w, "ircs_room_joins_total", atomic.LoadUint64(&roomJoins))
+
+	fmt.Fprintln(w, "# HELP ircs_handshake_successes_total Clients admitted to the chat.")
+	fmt.Fprintln(w, "# TYPE ircs_handshake_successes_total counter")
+	fmt.Fprintln(w, "ircs_handshake_successes_total", atomic.LoadUint64(&handshakeSuccesses))
+
+	fmt.Fprintln(w, "# HELP ircs_handshake_failures_total Clients refused, by reason.")
+	fmt.Fprintln(w, "# TYPE ircs_handshake_failures_total counter")
+	handshakeFailuresMu.Lock()
+	reasons := make([]string, 0, len(handshakeFailures))
+	for reason := range handshakeFailures {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "ircs_handshake_failures_total{reason=\"%s\"} %d\n", reason, handshakeFailures[reason])
+	}
+	handshakeFailuresMu.Unlock()
+
+	fmt.Fprintln(w, "# HELP ircs_outbound_queue_messages Messages waiting in all outbound queues.")
+	fmt.Fprintln(w, "# TYPE ircs_outbound_queue_messages gauge")
+	fmt.Fprintln(w, "ircs_outbound_queue_messages", queued)
+
+	fmt.Fprintln(w, "# HELP ircs_outbound_queue_max_depth Deepest outbound queue.")
+	fmt.Fprintln(w, "# TYPE ircs_outbound_queue_max_depth gauge")
+	fmt.Fprintln(w, "ircs_outbound_queue_max_depth", maxQueued)
+
+	fmt.Fprintln(w, "# HELP ircs_outbound_dropped_total Messages dropped because an outbound queue was full.")
+	fmt.Fprintln(w, "# TYPE ircs_outbound_dropped_total counter")
+	fmt.Fprintln(w, "ircs_outbound_dropped_total", atomic.LoadUint64(&messagesDropped))
+}
+
+func escapeLabel(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	return strings.ReplaceAll(value, "\n", `\n`)
+}
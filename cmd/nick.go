@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/pedroalbanese/gogost/gost34112012256"
+)
+
+// Maximum nickname length in runes, not counting the "@" prefix
+const maxNickLen = 32
+
+// nickRegistry maps a certificate key ID or identity, upper-cased, to the
+// nicknames bound to it
+var nickRegistry map[string][]string
+
+// sanitizeNick turns an arbitrary string such as a certificate CN into a
+// nickname that is safe for the "@user# text" wire format.
+func sanitizeNick(name string) string {
+	var b strings.Builder
+	for _, r := range strings.TrimPrefix(strings.TrimSpace(name), "@") {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("-_.", r) {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('_')
+		}
+	}
+	nick := []rune(strings.Trim(b.String(), "_"))
+	if len(nick) > maxNickLen {
+		nick = nick[:maxNickLen]
+	}
+	if len(nick) == 0 {
+		return "user"
+	}
+	return string(nick)
+}
+
+// loadNickRegistry reads a file of "<spki:hash|keyID|identity> <nick>"
+// lines binding nicknames to certificates. Blank lines and lines starting
+// with "#" are ignored.
+func loadNickRegistry(path string) (map[string][]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reg := make(map[string][]string)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"<spki:hash|keyID|identity> <nick>\"", path, line)
+		}
+		key := strings.ToUpper(fields[0])
+		reg[key] = append(reg[key], sanitizeNick(fields[1]))
+	}
+	return reg, scanner.Err()
+}
+
+// registeredNicks returns the nicknames bound to the client's certificate
+// key hash ("spki:<SHA-256>"), key ID or mapped identity. Like operator
+// entries, key IDs and identities only count for a certificate that
+// chains to a client CA, unless the key ID is computed from the key.
+func registeredNicks(client *Client) []string {
+	nicks := append([]string(nil), nickRegistry["SPKI:"+strings.ToUpper(spkiFingerprint(client.clientCert.RawSubjectPublicKeyInfo))]...)
+	if client.verified || keyIDFromKey() {
+		nicks = append(nicks, nickRegistry[strings.ToUpper(client.keyID)]...)
+	}
+	if client.verified && client.identity != "" {
+		nicks = append(nicks, nickRegistry[strings.ToUpper(client.identity)]...)
+	}
+	return nicks
+}
+
+// checkNickPolicy reports whether the client may take the given nickname
+// under the configured -nick policy.
+func checkNickPolicy(client *Client, nick string) error {
+	switch *nickPolicy {
+	case "free":
+		return nil
+	case "registry":
+		for _, allowed := range registeredNicks(client) {
+			if strings.EqualFold(allowed, nick) {
+				return nil
+			}
+		}
+		return errors.New("nickname " + nick + " is not registered to your certificate")
+	default:
+		return errors.New("nickname changes are disabled on this server")
+	}
+}
+
+// whois describes the certificate identity behind a nickname, with the
+// fingerprints of its public key for out-of-band verification.
+func whois(client *Client) string {
+	cert := client.clientCert
+	spkiSHA256 := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	spkiStreebog := gost34112012256.New()
+	spkiStreebog.Write(cert.RawSubjectPublicKeyInfo)
+	signature := cert.SignatureAlgorithm.String()
+	if oid, err := certSignatureOID(cert); err == nil {
+		signature = sigAlgName(oid)
+	}
+
+	info := "Identity of " + client.name() + ":\n"
+	info += "- Subject: " + cert.Subject.String() + "\n"
+	info += "- Issuer: " + cert.Issuer.String() + "\n"
+	info += "- Serial: " + fmt.Sprintf("%X", cert.SerialNumber) + "\n"
+	info += "- SKID: " + orNone(getClientSKID(cert)) + "\n"
+	info += "- AKID: " + orNone(getClientAKID(cert)) + "\n"
+	info += "- Valid: " + cert.NotBefore.UTC().Format(time.RFC3339) + " to " + cert.NotAfter.UTC().Format(time.RFC3339) + "\n"
+	if client.verified {
+		info += "- Chain: verified against the client CAs\n"
+	} else {
+		info += "- Chain: not verified\n"
+	}
+	info += "- Key: " + describePublicKey(cert.PublicKey) + ", signed with " + signature + "\n"
+	info += "- SPKI SHA-256: " + fmt.Sprintf("%X", spkiSHA256[:]) + "\n"
+	info += "- SPKI Streebog: " + fmt.Sprintf("%X", spkiStreebog.Sum(nil)) + "\n"
+	info += "- Identity: " + client.identity + "\n"
+	info += "- Key ID: " + client.keyID + " (" + *keyIDAlg + ")\n"
+	return info
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
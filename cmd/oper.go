@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Global bans by key ID, kept for the lifetime of the server
+var (
+	bans   = make(map[string]string)
+	bansMu sync.Mutex
+)
+
+// OIDs of the extended key usages that crypto/x509 parses into ExtKeyUsage
+var extKeyUsageOIDs = map[x509.ExtKeyUsage]asn1.ObjectIdentifier{
+	x509.ExtKeyUsageAny:                            {2, 5, 29, 37, 0},
+	x509.ExtKeyUsageServerAuth:                     {1, 3, 6, 1, 5, 5, 7, 3, 1},
+	x509.ExtKeyUsageClientAuth:                     {1, 3, 6, 1, 5, 5, 7, 3, 2},
+	x509.ExtKeyUsageCodeSigning:                    {1, 3, 6, 1, 5, 5, 7, 3, 3},
+	x509.ExtKeyUsageEmailProtection:                {1, 3, 6, 1, 5, 5, 7, 3, 4},
+	x509.ExtKeyUsageIPSECEndSystem:                 {1, 3, 6, 1, 5, 5, 7, 3, 5},
+	x509.ExtKeyUsageIPSECTunnel:                    {1, 3, 6, 1, 5, 5, 7, 3, 6},
+	x509.ExtKeyUsageIPSECUser:                      {1, 3, 6, 1, 5, 5, 7, 3, 7},
+	x509.ExtKeyUsageTimeStamping:                   {1, 3, 6, 1, 5, 5, 7, 3, 8},
+	x509.ExtKeyUsageOCSPSigning:                    {1, 3, 6, 1, 5, 5, 7, 3, 9},
+	x509.ExtKeyUsageMicrosoftServerGatedCrypto:     {1, 3, 6, 1, 4, 1, 311, 10, 3, 3},
+	x509.ExtKeyUsageNetscapeServerGatedCrypto:      {2, 16, 840, 1, 113730, 4, 1},
+	x509.ExtKeyUsageMicrosoftCommercialCodeSigning: {1, 3, 6, 1, 4, 1, 311, 2, 1, 22},
+	x509.ExtKeyUsageMicrosoftKernelCodeSigning:     {1, 3, 6, 1, 4, 1, 311, 61, 1, 1},
+}
+
+// isOperator reports whether the client's certificate matches an entry of
+// -opers. Entries are "spki:<SHA-256>" of the certificate public key, a
+// key ID or identity, "subject:<DN>", "policy:<OID>" or "eku:<OID>". A
+// certificate that does not chain to a client CA only matches by its
+// public key: "spki:" entries, or key IDs when -keyid hashes the key.
+func isOperator(client *Client) bool {
+	cert := client.clientCert
+	for _, oper := range strings.Split(*opers, ",") {
+		oper = strings.TrimSpace(oper)
+		switch {
+		case oper == "":
+		case strings.HasPrefix(oper, "spki:"):
+			if strings.EqualFold(strings.TrimPrefix(oper, "spki:"), spkiFingerprint(cert.RawSubjectPublicKeyInfo)) {
+				return true
+			}
+		case strings.EqualFold(oper, client.keyID) && (client.verified || keyIDFromKey()):
+			return true
+		case !client.verified:
+		case strings.HasPrefix(oper, "subject:"):
+			if cert.Subject.String() == strings.TrimPrefix(oper, "subject:") {
+				return true
+			}
+		case strings.HasPrefix(oper, "policy:"):
+			for _, policy := range cert.PolicyIdentifiers {
+				if policy.String() == strings.TrimPrefix(oper, "policy:") {
+					return true
+				}
+			}
+		case strings.HasPrefix(oper, "eku:"):
+			ekus := append([]asn1.ObjectIdentifier(nil), cert.UnknownExtKeyUsage...)
+			for _, usage := range cert.ExtKeyUsage {
+				ekus = append(ekus, extKeyUsageOIDs[usage])
+			}
+			for _, eku := range ekus {
+				if eku != nil && eku.String() == strings.TrimPrefix(oper, "eku:") {
+					return true
+				}
+			}
+		case strings.EqualFold(oper, client.identity):
+			return true
+		}
+	}
+	return false
+}
+
+func banReason(keyID string) (string, bool) {
+	bansMu.Lock()
+	defer bansMu.Unlock()
+
+	reason, banned := bans[keyID]
+	return reason, banned
+}
+
+func listBans() string {
+	bansMu.Lock()
+	defer bansMu.Unlock()
+
+	keys := make([]string, 0, len(bans))
+	for keyID := range bans {
+		keys = append(keys, keyID)
+	}
+	sort.Strings(keys)
+
+	list := "Bans on the server:\n"
+	for _, keyID := range keys {
+		list += "- " + keyID + " " + bans[keyID] + "\n"
+	}
+	return list
+}
+
+// killUser disconnects every session of the target.
+func killUser(target *Client, by, reason string) {
+	for _, session := range hub.sessionsOf(target.keyID) {
+		session.send(fmt.Sprintf("You were disconnected by %s: %s\n", by, reason))
+		hub.unregister(session)
+	}
+}
+
+// kickUser removes every session of the target from the room.
+func kickUser(target *Client, room *Room, by string) {
+	for _, session := range hub.sessionsOf(target.keyID) {
+		if findClientRoom(session, room.name) != nil {
+			session.send(fmt.Sprintf("You were kicked from room %s by %s.\n", room.name, by))
+			leaveRoom(session, room)
+		}
+	}
+}
+
+// Flags holding passwords or tokens, never shown by CONFIG
+var secretFlags = map[string]bool{"pwd": true, "capwd": true, "enrolltoken": true}
+
+// configDump lists the effective server settings, with secrets redacted.
+func configDump() string {
+	dump := "Server configuration:\n"
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		switch {
+		case secretFlags[f.Name] && value != "":
+			value = "(redacted)"
+		case f.Name == "key" && strings.HasPrefix(value, "pkcs11:"):
+			value = redactPIN(value)
+		}
+		dump += "- " + f.Name + " = " + value + "\n"
+	})
+	return dump
+}
+
+// redactPIN hides the pin-value attribute of a PKCS#11 URI.
+func redactPIN(uri string) string {
+	path, query, found := strings.Cut(uri, "?")
+	if !found {
+		return uri
+	}
+	attrs := strings.Split(query, "&")
+	for i, attr := range attrs {
+		if strings.HasPrefix(attr, "pin-value=") {
+			attrs[i] = "pin-value=(redacted)"
+		}
+	}
+	return path + "?" + strings.Join(attrs, "&")
+}
+
+// handleOperCommand runs the operator and room-owner commands. It returns
+// false if the message is not one of them.
+func handleOperCommand(client *Client, message string) bool {
+	command, args, _ := strings.Cut(message, " ")
+	args = strings.TrimSpace(args)
+
+	switch command {
+	case "WALLOPS", "ANNOUNCE", "KILL", "BAN", "UNBAN", "BANS", "TAKEOVER", "CONFIG":
+		if !client.oper {
+			client.send("Permission denied: you are not a server operator.\n")
+			return true
+		}
+	case "KICK":
+	default:
+		return false
+	}
+
+	switch command {
+	case "WALLOPS", "ANNOUNCE":
+		announcement := fmt.Sprintf("*** Announcement from %s: %s", client.name(), args)
+		hub.broadcast(announcement + "\n")
+		auditOper(client.name(), "announce")
+	case "KILL", "BAN":
+		nick, reason, _ := strings.Cut(args, " ")
+		target := hub.findClient(nick)
+		if target == nil {
+			client.send("No such user.\n")
+			return true
+		}
+		if reason == "" {
+			reason = "no reason given"
+		}
+		if command == "BAN" {
+			bansMu.Lock()
+			bans[target.keyID] = reason
+			bansMu.Unlock()
+		}
+		auditOper(client.name(), strings.ToLower(command), "target", target.name(), "keyid", target.keyID, "reason", reason)
+		killUser(target, client.name(), reason)
+	case "UNBAN":
+		bansMu.Lock()
+		_, banned := bans[strings.ToUpper(args)]
+		delete(bans, strings.ToUpper(args))
+		bansMu.Unlock()
+		if !banned {
+			client.send("No such ban.\n")
+			return true
+		}
+		auditOper(client.name(), "unban", "keyid", strings.ToUpper(args))
+		client.send("Unbanned " + strings.ToUpper(args) + ".\n")
+	case "BANS":
+		client.send(listBans())
+	case "TAKEOVER":
+		room := hub.findRoom(args)
+		if room == nil {
+			client.send("No such room: " + args + "\n")
+			return true
+		}
+		room.mu.Lock()
+		room.owner = client.keyID
+		room.mu.Unlock()
+		for _, c := range room.members() {
+			c.send(fmt.Sprintf("[%s] %s took over the room.\n", room.name, client.name()))
+		}
+		auditOper(client.name(), "takeover", "room", room.name)
+		client.send("You now own room " + room.name + ".\n")
+	case "CONFIG":
+		auditOper(client.name(), "config")
+		client.send(configDump())
+	case "KICK":
+		// KICK <nick> [room] is open to room owners as well as operators
+		nick, roomName, _ := strings.Cut(args, " ")
+		room := currentRoom(client)
+		if roomName = strings.TrimSpace(roomName); roomName != "" {
+			room = hub.findRoom(roomName)
+		}
+		if room == nil {
+			client.send("No such room.\n")
+			return true
+		}
+		room.mu.Lock()
+		owner := room.owner
+		room.mu.Unlock()
+		if !client.oper && owner != client.keyID {
+			client.send("Permission denied: you do not own room " + room.name + ".\n")
+			return true
+		}
+		target := hub.findClient(nick)
+		if target == nil {
+			client.send("No such user.\n")
+			return true
+		}
+		if client.oper {
+			auditOper(client.name(), "kick", "target", target.name(), "keyid", target.keyID, "room", room.name)
+		} else {
+			auditRoom(client.name(), "kick", "target", target.name(), "keyid", target.keyID, "room", room.name)
+		}
+		kickUser(target, room, client.name())
+	}
+	return true
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"flag"
+	"strings"
+	"testing"
+)
+
+// setFlag sets a flag for the duration of a test.
+func setFlag(t *testing.T, name, value string) {
+	t.Helper()
+	old := flag.Lookup(name).Value.String()
+	if err := flag.Set(name, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { flag.Set(name, old) })
+}
+
+func TestOperatorNeedsVerifiedChain(t *testing.T) {
+	ca, caKey := newTestCert(t, testCert{subject: "Test CA", ca: true})
+	admin, _ := newTestCert(t, testCert{subject: "admin", skid: []byte{1, 2, 3, 4}, issuer: ca, signer: caKey})
+	// Anyone can self-sign the operator's subject and key ID
+	spoof, _ := newTestCert(t, testCert{subject: "admin", skid: admin.SubjectKeyId})
+	setClientCAs(t, ca)
+
+	login := func(cert *x509.Certificate) *Client {
+		client := newClient(nil, "@admin", cert, clientKeyID(cert))
+		client.identity = "admin"
+		client.verified = verifyClientChain([]*x509.Certificate{cert})
+		return client
+	}
+	spki := spkiFingerprint(admin.RawSubjectPublicKeyInfo)
+
+	tests := []struct {
+		opers  string
+		keyID  string
+		admin  bool
+		spoofs bool
+	}{
+		{"subject:CN=admin", "skid", true, false},
+		{"admin", "skid", true, false},
+		{getClientSKID(admin), "skid", true, false},
+		{"spki:" + spki, "skid", true, false},
+		{"spki:" + strings.ToUpper(spki), "skid", true, false},
+		// Key IDs hashed from the key hold without a chain
+		{"sha256", "sha256", true, false},
+		{"policy:1.2.3.4", "skid", false, false},
+	}
+	for _, tt := range tests {
+		setFlag(t, "keyid", tt.keyID)
+		opers := tt.opers
+		if opers == "sha256" {
+			opers = clientKeyID(admin)
+		}
+		setFlag(t, "opers", "nobody, "+opers)
+		if got := isOperator(login(admin)); got != tt.admin {
+			t.Errorf("%s: operator = %v, want %v", tt.opers, got, tt.admin)
+		}
+		if got := isOperator(login(spoof)); got != tt.spoofs {
+			t.Errorf("%s: self-signed lookalike is operator = %v", tt.opers, got)
+		}
+	}
+}
+
+func TestOperatorPolicyAndEKU(t *testing.T) {
+	ca, caKey := newTestCert(t, testCert{subject: "Test CA", ca: true})
+	setClientCAs(t, ca)
+
+	template := testCert{subject: "oper", issuer: ca, signer: caKey}
+	cert, _ := newTestCert(t, template)
+	cert.PolicyIdentifiers = []asn1.ObjectIdentifier{{1, 2, 3, 4}}
+	cert.UnknownExtKeyUsage = []asn1.ObjectIdentifier{{1, 2, 3, 5}}
+	client := newClient(nil, "@oper", cert, "KEY")
+
+	for _, verified := range []bool{true, false} {
+		client.verified = verified
+		for _, opers := range []string{"policy:1.2.3.4", "eku:1.2.3.5"} {
+			setFlag(t, "opers", opers)
+			if got := isOperator(client); got != verified {
+				t.Errorf("%s with verified chain %v: operator = %v", opers, verified, got)
+			}
+		}
+	}
+}
+
+func TestOperatorStandardEKU(t *testing.T) {
+	ca, caKey := newTestCert(t, testCert{subject: "Test CA", ca: true})
+	setClientCAs(t, ca)
+
+	cert, _ := newTestCert(t, testCert{subject: "oper", issuer: ca, signer: caKey, eku: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	client := newClient(nil, "@oper", cert, "KEY")
+	client.verified = true
+
+	for opers, want := range map[string]bool{
+		"eku:1.3.6.1.5.5.7.3.2": true,
+		"eku:1.3.6.1.5.5.7.3.1": false,
+	} {
+		setFlag(t, "opers", opers)
+		if got := isOperator(client); got != want {
+			t.Errorf("%s with clientAuth: operator = %v, want %v", opers, got, want)
+		}
+	}
+}
+
+func TestRegisteredNicksNeedVerifiedChain(t *testing.T) {
+	ca, caKey := newTestCert(t, testCert{subject: "Test CA", ca: true})
+	alice, _ := newTestCert(t, testCert{subject: "alice", skid: []byte{5, 6, 7, 8}, issuer: ca, signer: caKey})
+	spoof, _ := newTestCert(t, testCert{subject: "alice", skid: alice.SubjectKeyId})
+	setClientCAs(t, ca)
+	setFlag(t, "keyid", "skid")
+
+	old := nickRegistry
+	defer func() { nickRegistry = old }()
+	nickRegistry = map[string][]string{
+		strings.ToUpper(getClientSKID(alice)): {"alice"},
+		"ALICE":                               {"ally"},
+		"SPKI:" + strings.ToUpper(spkiFingerprint(alice.RawSubjectPublicKeyInfo)): {"al"},
+	}
+
+	login := func(cert *x509.Certificate) *Client {
+		client := newClient(nil, "@alice", cert, clientKeyID(cert))
+		client.identity = "alice"
+		client.verified = verifyClientChain([]*x509.Certificate{cert})
+		return client
+	}
+	if got := registeredNicks(login(alice)); len(got) != 3 {
+		t.Errorf("verified certificate has nicknames %v, want 3", got)
+	}
+	if got := registeredNicks(login(spoof)); len(got) != 0 {
+		t.Errorf("self-signed lookalike has nicknames %v", got)
+	}
+
+	// Without client CAs only the key hash holds
+	setClientCAs(t)
+	if got := registeredNicks(login(alice)); len(got) != 1 || got[0] != "al" {
+		t.Errorf("unverified certificate has nicknames %v, want [al]", got)
+	}
+}
+
+func TestConfigDumpRedactsSecrets(t *testing.T) {
+	setFlag(t, "pwd", "keypassword")
+	setFlag(t, "capwd", "capassword")
+	setFlag(t, "enrolltoken", "token1,token2")
+	setFlag(t, "key", "pkcs11:token=chat;object=key?module-path=/usr/lib/softhsm.so&pin-value=1234")
+
+	dump := configDump()
+	for _, secret := range []string{"keypassword", "capassword", "token1", "1234"} {
+		if strings.Contains(dump, secret) {
+			t.Errorf("CONFIG shows %q:\n%s", secret, dump)
+		}
+	}
+	for _, want := range []string{
+		"- pwd = (redacted)",
+		"- key = pkcs11:token=chat;object=key?module-path=/usr/lib/softhsm.so&pin-value=(redacted)",
+		"- mode = ",
+	} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("CONFIG lacks %q:\n%s", want, dump)
+		}
+	}
+
+	setFlag(t, "pwd", "")
+	if !strings.Contains(configDump(), "- pwd = \n") {
+		t.Error("an unset secret should show as empty")
+	}
+}
+
+func TestRoomOwnerKickIsAudited(t *testing.T) {
+	server := setTestServer(t)
+	buf := setAuditOutput(t, nil, false)
+
+	owner := connectSession(t, server, "kick-owner")
+	guest := connectSession(t, server, "kick-guest")
+	owner.send("JOIN #kick-audit")
+	owner.expect("Joined room")
+	guest.send("JOIN #kick-audit")
+	guest.expect("Joined room")
+	owner.send("KICK @kick-guest #kick-audit")
+	guest.expect("You were kicked")
+	owner.quit()
+	guest.quit()
+
+	for _, want := range []string{`"event":"room"`, `"action":"kick"`, `"target":"@kick-guest"`, `"room":"#kick-audit"`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("%s missing from the audit log:\n%s", want, buf.String())
+		}
+	}
+}
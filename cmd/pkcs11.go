@@ -0,0 +1,164 @@
+//go:build pkcs11
+
+package main
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ThalesIgnite/crypto11"
+)
+
+// pkcs11URI holds the attributes of an RFC 7512 "pkcs11:" URI that select
+// a private key on a token.
+type pkcs11URI struct {
+	token      string
+	serial     string
+	slot       *int
+	object     string
+	id         []byte
+	modulePath string
+	pin        string
+}
+
+// Open PKCS#11 sessions, one per module and token, kept for the life of
+// the process so that keys stay usable
+var (
+	pkcs11Mu       sync.Mutex
+	pkcs11Contexts = make(map[string]*crypto11.Context)
+)
+
+// parsePKCS11URI parses a URI such as
+// "pkcs11:token=ircs;object=alice?module-path=/usr/lib/softhsm/libsofthsm2.so".
+func parsePKCS11URI(uri string) (*pkcs11URI, error) {
+	path, query, _ := strings.Cut(strings.TrimPrefix(uri, "pkcs11:"), "?")
+	k := &pkcs11URI{}
+
+	for _, attr := range strings.Split(path, ";") {
+		if attr == "" {
+			continue
+		}
+		name, raw, ok := strings.Cut(attr, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed PKCS#11 URI attribute %q", attr)
+		}
+		value, err := url.PathUnescape(raw)
+		if err != nil {
+			return nil, fmt.Errorf("malformed PKCS#11 URI attribute %q", attr)
+		}
+		switch name {
+		case "token":
+			k.token = value
+		case "serial":
+			k.serial = value
+		case "slot-id":
+			slot, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid PKCS#11 slot-id %q", value)
+			}
+			k.slot = &slot
+		case "object":
+			k.object = value
+		case "id":
+			k.id = []byte(value)
+		case "type":
+			if value != "private" {
+				return nil, errors.New("the PKCS#11 URI must select a private key object")
+			}
+		case "manufacturer", "model", "library-manufacturer", "library-description", "library-version":
+			// Not needed to find the token
+		default:
+			return nil, fmt.Errorf("unknown PKCS#11 URI attribute %q", name)
+		}
+	}
+
+	for _, attr := range strings.Split(query, "&") {
+		if attr == "" {
+			continue
+		}
+		name, raw, _ := strings.Cut(attr, "=")
+		value, err := url.QueryUnescape(raw)
+		if err != nil {
+			return nil, fmt.Errorf("malformed PKCS#11 URI attribute %q", attr)
+		}
+		switch name {
+		case "module-path":
+			k.modulePath = value
+		case "pin-value":
+			k.pin = value
+		case "pin-source":
+			pin, err := ioutil.ReadFile(strings.TrimPrefix(value, "file:"))
+			if err != nil {
+				return nil, err
+			}
+			k.pin = strings.TrimRight(string(pin), "\r\n")
+		default:
+			return nil, fmt.Errorf("unsupported PKCS#11 URI attribute %q", name)
+		}
+	}
+
+	switch {
+	case k.modulePath == "":
+		return nil, errors.New("the PKCS#11 URI needs a module-path")
+	case k.token == "" && k.serial == "" && k.slot == nil:
+		return nil, errors.New("the PKCS#11 URI needs a token, serial or slot-id")
+	case k.object == "" && k.id == nil:
+		return nil, errors.New("the PKCS#11 URI needs an object or id")
+	}
+	return k, nil
+}
+
+// loadPKCS11Key finds a private key on a PKCS#11 token. The PIN is taken
+// from the URI, or else from password.
+func loadPKCS11Key(uri string, password []byte) (crypto.Signer, error) {
+	k, err := parsePKCS11URI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	pkcs11Mu.Lock()
+	defer pkcs11Mu.Unlock()
+
+	session := strings.Join([]string{k.modulePath, k.token, k.serial}, "|")
+	if k.slot != nil {
+		session += "|" + strconv.Itoa(*k.slot)
+	}
+	ctx, ok := pkcs11Contexts[session]
+	if !ok {
+		config := &crypto11.Config{Path: k.modulePath, Pin: k.pin}
+		if config.Pin == "" {
+			config.Pin = string(password)
+		}
+		switch {
+		case k.serial != "":
+			config.TokenSerial = k.serial
+		case k.token != "":
+			config.TokenLabel = k.token
+		default:
+			config.SlotNumber = k.slot
+		}
+		if ctx, err = crypto11.Configure(config); err != nil {
+			return nil, err
+		}
+		pkcs11Contexts[session] = ctx
+	}
+
+	var label []byte
+	if k.object != "" {
+		label = []byte(k.object)
+	}
+	signer, err := ctx.FindKeyPair(k.id, label)
+	if err != nil {
+		return nil, err
+	}
+	if signer == nil {
+		return nil, errors.New("no such private key on the PKCS#11 token")
+	}
+	return signer, nil
+}
@@ -0,0 +1,14 @@
+//go:build !pkcs11
+
+package main
+
+import (
+	"crypto"
+	"errors"
+)
+
+// loadPKCS11Key is only available in builds with the pkcs11 tag, which
+// need cgo for the PKCS#11 module.
+func loadPKCS11Key(uri string, password []byte) (crypto.Signer, error) {
+	return nil, errors.New("PKCS#11 keys are not supported by this build, rebuild with -tags pkcs11")
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"hash"
+	"io"
+
+	"github.com/pedroalbanese/gogost/gost34112012256"
+	"github.com/pedroalbanese/gogost/gost34112012512"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// PKCS#8 EncryptedPrivateKeyInfo with PBES2 (RFC 8018), the "ENCRYPTED
+// PRIVATE KEY" PEM blocks written by OpenSSL, alongside the legacy
+// DEK-Info encryption of PEM_decrypt.go.
+
+var (
+	oidPBES2  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidScrypt = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11591, 4, 11}
+)
+
+// Work factors of newly encrypted keys; the scrypt ones are the OpenSSL
+// defaults, which fit its memory limit
+const (
+	pbkdf2Iterations = 100000
+	scryptN          = 1 << 14
+	scryptR          = 8
+	scryptP          = 1
+)
+
+// Bounds on the work factors read from a key file, so that a crafted file
+// cannot tie up the CPU or memory for long
+const (
+	maxPBKDF2Iterations = 10000000
+	maxScryptN          = 1 << 20
+	maxScryptRP         = 64
+)
+
+// Kuznechik CTR-ACPKM changes its key every section (RFC 8645, with the
+// section size of RFC 9337)
+const acpkmSection = 256 * 1024
+
+// D constant of the ACPKM key transform (RFC 8645, section 6.1)
+var acpkmD = []byte{
+	0x80, 0x81, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89, 0x8A, 0x8B, 0x8C, 0x8D, 0x8E, 0x8F,
+	0x90, 0x91, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98, 0x99, 0x9A, 0x9B, 0x9C, 0x9D, 0x9E, 0x9F,
+}
+
+type pbes2Cipher struct {
+	name   string
+	oid    asn1.ObjectIdentifier
+	cipher PEMCipher
+	acpkm  bool // CTR-ACPKM with an 8-byte UKM (RFC 9337) instead of CBC
+}
+
+// Encryption schemes of PKCS#8 keys, built on the ciphers of rfc1423Algos
+var pbes2Ciphers = []pbes2Cipher{
+	{"AES-128-CBC", asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}, PEMCipherAES128, false},
+	{"AES-192-CBC", asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}, PEMCipherAES192, false},
+	{"AES-256-CBC", asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}, PEMCipherAES256, false},
+	{"KUZNECHIK-CTR-ACPKM", asn1.ObjectIdentifier{1, 2, 643, 7, 1, 1, 5, 2, 1}, PEMCipherGOST, true},
+	{"DES-EDE3-CBC", asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}, PEMCipher3DES, false},
+	{"SM4-CBC", asn1.ObjectIdentifier{1, 2, 156, 10197, 1, 104, 2}, PEMCipherSM4, false},
+	{"ARIA-128-CBC", asn1.ObjectIdentifier{1, 2, 410, 200046, 1, 1, 2}, PEMCipherARIA128, false},
+	{"ARIA-192-CBC", asn1.ObjectIdentifier{1, 2, 410, 200046, 1, 1, 7}, PEMCipherARIA192, false},
+	{"ARIA-256-CBC", asn1.ObjectIdentifier{1, 2, 410, 200046, 1, 1, 12}, PEMCipherARIA256, false},
+	{"CAMELLIA-128-CBC", asn1.ObjectIdentifier{1, 2, 392, 200011, 61, 1, 1, 1, 2}, PEMCipherCAMELLIA128, false},
+	{"CAMELLIA-192-CBC", asn1.ObjectIdentifier{1, 2, 392, 200011, 61, 1, 1, 1, 3}, PEMCipherCAMELLIA192, false},
+	{"CAMELLIA-256-CBC", asn1.ObjectIdentifier{1, 2, 392, 200011, 61, 1, 1, 1, 4}, PEMCipherCAMELLIA256, false},
+	{"SEED-CBC", asn1.ObjectIdentifier{1, 2, 410, 200004, 1, 4}, PEMCipherSEED, false},
+}
+
+// PBKDF2 pseudorandom functions; the name is the -kdf value selecting it
+var pbkdf2PRFs = []struct {
+	name string
+	oid  asn1.ObjectIdentifier
+	hash func() hash.Hash
+}{
+	{"pbkdf2", asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}, sha256.New},
+	{"pbkdf2-sha512", asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}, sha512.New},
+	{"pbkdf2-streebog", asn1.ObjectIdentifier{1, 2, 643, 7, 1, 1, 4, 2}, gost34112012512.New},
+	{"pbkdf2-streebog256", asn1.ObjectIdentifier{1, 2, 643, 7, 1, 1, 4, 1}, gost34112012256.New},
+	{"pbkdf2-sha1", asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}, sha1.New},
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+type scryptParams struct {
+	Salt                     []byte
+	CostParameter            int
+	BlockSize                int
+	ParallelizationParameter int
+	KeyLength                int `asn1:"optional"`
+}
+
+// gostCipherParams are the Gost3412-15-Encryption-Parameters of RFC 9337.
+type gostCipherParams struct {
+	UKM []byte
+}
+
+func pbes2CipherByName(name string) *pbes2Cipher {
+	for i := range pbes2Ciphers {
+		if pbes2Ciphers[i].name == name {
+			return &pbes2Ciphers[i]
+		}
+	}
+	return nil
+}
+
+func pbes2CipherByOID(oid asn1.ObjectIdentifier) *pbes2Cipher {
+	for i := range pbes2Ciphers {
+		if pbes2Ciphers[i].oid.Equal(oid) {
+			return &pbes2Ciphers[i]
+		}
+	}
+	return nil
+}
+
+// IsEncryptedPKCS8Block reports whether b is a PKCS#8 encrypted private key.
+func IsEncryptedPKCS8Block(b *pem.Block) bool {
+	return b.Type == "ENCRYPTED PRIVATE KEY"
+}
+
+// pbes2Key derives the encryption key from the password with the PBKDF2
+// or scrypt parameters of kdf.
+func pbes2Key(kdf pkix.AlgorithmIdentifier, password []byte, keySize int) ([]byte, error) {
+	switch {
+	case kdf.Algorithm.Equal(oidPBKDF2):
+		var params pbkdf2Params
+		if _, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &params); err != nil {
+			return nil, errors.New("pkcs8: malformed PBKDF2 parameters")
+		}
+		if params.KeyLength != 0 && params.KeyLength != keySize {
+			return nil, errors.New("pkcs8: PBKDF2 key length does not match the cipher")
+		}
+		if params.IterationCount <= 0 || params.IterationCount > maxPBKDF2Iterations {
+			return nil, errors.New("pkcs8: invalid PBKDF2 iteration count")
+		}
+		h := sha1.New
+		if len(params.PRF.Algorithm) > 0 {
+			h = nil
+			for _, prf := range pbkdf2PRFs {
+				if prf.oid.Equal(params.PRF.Algorithm) {
+					h = prf.hash
+				}
+			}
+			if h == nil {
+				return nil, errors.New("pkcs8: unsupported PBKDF2 function " + params.PRF.Algorithm.String())
+			}
+		}
+		return pbkdf2.Key(password, params.Salt, params.IterationCount, keySize, h), nil
+	case kdf.Algorithm.Equal(oidScrypt):
+		var params scryptParams
+		if _, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &params); err != nil {
+			return nil, errors.New("pkcs8: malformed scrypt parameters")
+		}
+		if params.KeyLength != 0 && params.KeyLength != keySize {
+			return nil, errors.New("pkcs8: scrypt key length does not match the cipher")
+		}
+		if err := checkScryptParams(params.CostParameter, params.BlockSize, params.ParallelizationParameter); err != nil {
+			return nil, err
+		}
+		return scrypt.Key(password, params.Salt, params.CostParameter, params.BlockSize, params.ParallelizationParameter, keySize)
+	}
+	return nil, errors.New("pkcs8: unsupported key derivation function " + kdf.Algorithm.String())
+}
+
+// checkScryptParams rejects scrypt parameters outside the bounds.
+func checkScryptParams(n, r, p int) error {
+	if n <= 1 || n > maxScryptN || n&(n-1) != 0 {
+		return errors.New("pkcs8: invalid scrypt cost parameter")
+	}
+	if r <= 0 || p <= 0 || r*p > maxScryptRP {
+		return errors.New("pkcs8: invalid scrypt block size or parallelization")
+	}
+	return nil
+}
+
+// parsePBES2 splits a PKCS#8 EncryptedPrivateKeyInfo into its PBES2
+// parameters, encryption scheme and ciphertext.
+func parsePBES2(der []byte) (*pbes2Params, *pbes2Cipher, []byte, error) {
+	var info encryptedPrivateKeyInfo
+	if rest, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, nil, nil, errors.New("pkcs8: malformed encrypted private key")
+	} else if len(rest) > 0 {
+		return nil, nil, nil, errors.New("pkcs8: trailing data after encrypted private key")
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, nil, nil, errors.New("pkcs8: unsupported encryption scheme " + info.Algorithm.Algorithm.String())
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, nil, nil, errors.New("pkcs8: malformed PBES2 parameters")
+	}
+	ciph := pbes2CipherByOID(params.EncryptionScheme.Algorithm)
+	if ciph == nil {
+		return nil, nil, nil, errors.New("pkcs8: unsupported cipher " + params.EncryptionScheme.Algorithm.String())
+	}
+	return &params, ciph, info.EncryptedData, nil
+}
+
+// pbes2Scheme describes how a PKCS#8 key is encrypted.
+type pbes2Scheme struct {
+	cipher     string // name in pbes2Ciphers
+	kdf        string // -kdf name
+	iv         []byte
+	salt       []byte
+	iterations int // PBKDF2
+	n, r, p    int // scrypt
+}
+
+// inspectPKCS8 returns the encryption scheme of a PKCS#8
+// EncryptedPrivateKeyInfo.
+func inspectPKCS8(der []byte) (*pbes2Scheme, error) {
+	params, ciph, _, err := parsePBES2(der)
+	if err != nil {
+		return nil, err
+	}
+	scheme := &pbes2Scheme{cipher: ciph.name}
+	alg := cipherByKey(ciph.cipher)
+	if scheme.iv, err = ciph.iv(params.EncryptionScheme.Parameters.FullBytes, alg.blockSize); err != nil {
+		return nil, err
+	}
+
+	kdf := params.KeyDerivationFunc
+	switch {
+	case kdf.Algorithm.Equal(oidPBKDF2):
+		var p pbkdf2Params
+		if _, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &p); err != nil {
+			return nil, errors.New("pkcs8: malformed PBKDF2 parameters")
+		}
+		scheme.kdf, scheme.salt, scheme.iterations = "pbkdf2-sha1", p.Salt, p.IterationCount
+		for _, prf := range pbkdf2PRFs {
+			if prf.oid.Equal(p.PRF.Algorithm) {
+				scheme.kdf = prf.name
+			}
+		}
+	case kdf.Algorithm.Equal(oidScrypt):
+		var p scryptParams
+		if _, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &p); err != nil {
+			return nil, errors.New("pkcs8: malformed scrypt parameters")
+		}
+		scheme.kdf, scheme.salt = "scrypt", p.Salt
+		scheme.n, scheme.r, scheme.p = p.CostParameter, p.BlockSize, p.ParallelizationParameter
+	default:
+		return nil, errors.New("pkcs8: unsupported key derivation function " + kdf.Algorithm.String())
+	}
+	return scheme, nil
+}
+
+// iv decodes the IV (or the UKM of CTR-ACPKM) from the parameters of the
+// encryption scheme.
+func (c *pbes2Cipher) iv(params []byte, blockSize int) ([]byte, error) {
+	var iv []byte
+	if c.acpkm {
+		var gost gostCipherParams
+		if _, err := asn1.Unmarshal(params, &gost); err != nil {
+			return nil, errors.New("pkcs8: malformed cipher parameters")
+		}
+		iv = gost.UKM
+		blockSize /= 2
+	} else if _, err := asn1.Unmarshal(params, &iv); err != nil {
+		return nil, errors.New("pkcs8: malformed cipher parameters")
+	}
+	if len(iv) != blockSize {
+		return nil, errors.New("pkcs8: incorrect IV size")
+	}
+	return iv, nil
+}
+
+// crypt encrypts or decrypts data with the scheme's cipher.
+func (c *pbes2Cipher) crypt(key, iv, data []byte, encrypt bool) ([]byte, error) {
+	alg := cipherByKey(c.cipher)
+	block, err := alg.cipherFunc(key)
+	if err != nil {
+		return nil, err
+	}
+	if c.acpkm {
+		return ctrACPKM(alg.cipherFunc, block, iv, data, acpkmSection)
+	}
+	if encrypt {
+		out := pad(data, alg.blockSize)
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, out)
+		return out, nil
+	}
+	if len(data) == 0 || len(data)%alg.blockSize != 0 {
+		return nil, errors.New("pkcs8: encrypted data is not a multiple of the block size")
+	}
+	out := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+	return unpad(out, alg.blockSize)
+}
+
+// ctrACPKM runs CTR-ACPKM (RFC 8645, section 6.2.2): CTR mode starting
+// from IV || 0, whose key is replaced after every section by the
+// encryption of the constant D under the current key.
+func ctrACPKM(newCipher func([]byte) (cipher.Block, error), block cipher.Block, iv, data []byte, section int) ([]byte, error) {
+	size := block.BlockSize()
+	counter := make([]byte, size)
+	copy(counter, iv)
+	keystream := make([]byte, size)
+	out := make([]byte, len(data))
+	for i := 0; i < len(data); i += size {
+		if i > 0 && i%section == 0 {
+			key := make([]byte, len(acpkmD))
+			for j := 0; j < len(key); j += size {
+				block.Encrypt(key[j:j+size], acpkmD[j:j+size])
+			}
+			var err error
+			if block, err = newCipher(key); err != nil {
+				return nil, err
+			}
+		}
+		block.Encrypt(keystream, counter)
+		for j := len(counter) - 1; j >= 0; j-- {
+			counter[j]++
+			if counter[j] != 0 {
+				break
+			}
+		}
+		end := i + size
+		if end > len(data) {
+			end = len(data)
+		}
+		for j := i; j < end; j++ {
+			out[j] = data[j] ^ keystream[j-i]
+		}
+	}
+	return out, nil
+}
+
+// DecryptPKCS8 decrypts a PKCS#8 EncryptedPrivateKeyInfo and returns the
+// PrivateKeyInfo DER.
+func DecryptPKCS8(der, password []byte) ([]byte, error) {
+	params, ciph, encrypted, err := parsePBES2(der)
+	if err != nil {
+		return nil, err
+	}
+	alg := cipherByKey(ciph.cipher)
+	key, err := pbes2Key(params.KeyDerivationFunc, password, alg.keySize)
+	if err != nil {
+		return nil, err
+	}
+	iv, err := ciph.iv(params.EncryptionScheme.Parameters.FullBytes, alg.blockSize)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ciph.crypt(key, iv, encrypted, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// CTR has no padding to check: a wrong password gives garbage
+	var raw asn1.RawValue
+	if rest, err := asn1.Unmarshal(data, &raw); err != nil || len(rest) > 0 || raw.Tag != asn1.TagSequence {
+		return nil, IncorrectPasswordError
+	}
+	return data, nil
+}
+
+// EncryptPKCS8 encrypts a PrivateKeyInfo DER as an "ENCRYPTED PRIVATE KEY"
+// block. kdf is "scrypt" or the name of a PBKDF2 function in pbkdf2PRFs.
+func EncryptPKCS8(rand io.Reader, der, password []byte, cipherName, kdf string) (*pem.Block, error) {
+	ciph := pbes2CipherByName(cipherName)
+	if ciph == nil {
+		return nil, errors.New("pkcs8: cipher not available for PKCS#8: " + cipherName)
+	}
+	alg := cipherByKey(ciph.cipher)
+
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand, salt); err != nil {
+		return nil, errors.New("pkcs8: cannot generate salt: " + err.Error())
+	}
+	var kdfAlg pkix.AlgorithmIdentifier
+	var params interface{}
+	if kdf == "scrypt" {
+		kdfAlg.Algorithm = oidScrypt
+		params = scryptParams{salt, scryptN, scryptR, scryptP, alg.keySize}
+	} else {
+		for _, prf := range pbkdf2PRFs {
+			if prf.name == kdf {
+				kdfAlg.Algorithm = oidPBKDF2
+				params = pbkdf2Params{salt, pbkdf2Iterations, alg.keySize,
+					pkix.AlgorithmIdentifier{Algorithm: prf.oid, Parameters: asn1.NullRawValue}}
+			}
+		}
+		if params == nil {
+			return nil, errors.New("pkcs8: unknown key derivation function: " + kdf)
+		}
+	}
+	var err error
+	if kdfAlg.Parameters.FullBytes, err = asn1.Marshal(params); err != nil {
+		return nil, err
+	}
+	key, err := pbes2Key(kdfAlg, password, alg.keySize)
+	if err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, alg.blockSize)
+	if ciph.acpkm {
+		iv = iv[:alg.blockSize/2]
+	}
+	if _, err := io.ReadFull(rand, iv); err != nil {
+		return nil, errors.New("pkcs8: cannot generate IV: " + err.Error())
+	}
+	scheme := pkix.AlgorithmIdentifier{Algorithm: ciph.oid}
+	if ciph.acpkm {
+		scheme.Parameters.FullBytes, err = asn1.Marshal(gostCipherParams{iv})
+	} else {
+		scheme.Parameters.FullBytes, err = asn1.Marshal(iv)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted, err := ciph.crypt(key, iv, der, true)
+	if err != nil {
+		return nil, err
+	}
+	pbes2, err := asn1.Marshal(pbes2Params{kdfAlg, scheme})
+	if err != nil {
+		return nil, err
+	}
+	out, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: pbes2}},
+		EncryptedData: encrypted,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: out}, nil
+}
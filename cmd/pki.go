@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server certificate, key and revocation state, replaced on reload
+var (
+	pkiMu          sync.RWMutex
+	serverKeyPair  *tls.Certificate
+	serverCert     *x509.Certificate
+	serverCRL      *pkix.CertificateList
+	clientCAs      *x509.CertPool
+	revokedSerials = make(map[string]time.Time)
+)
+
+// loadServerPKI (re)loads the server certificate, private key, CRL and
+// client CAs from the -cert, -key, -crl and -clientca files.
+func loadServerPKI() error {
+	// Load the server certificate and private key
+	cert, err := loadKeyPair(*certFile, *keyFile, []byte(*keyPass))
+	if err != nil {
+		return err
+	}
+
+	certPEM, err := ioutil.ReadFile(*certFile)
+	if err != nil {
+		return err
+	}
+	certPemBlock, _ := pem.Decode(certPEM)
+	if certPemBlock == nil {
+		return errors.New("no certificate found in " + *certFile)
+	}
+	parsed, err := x509.ParseCertificate(certPemBlock.Bytes)
+	if err != nil {
+		return err
+	}
+
+	var crl *pkix.CertificateList
+	if *crlFile != "" {
+		// Load the CRL from a file
+		crlBytes, err := ioutil.ReadFile(*crlFile)
+		if err != nil {
+			return err
+		}
+		crl, err = x509.ParseCRL(crlBytes)
+		if err != nil {
+			return err
+		}
+	}
+
+	pool, err := loadClientCAs(cert)
+	if err != nil {
+		return err
+	}
+
+	// A new key must keep signing the audit trail
+	if auditSigning() {
+		if _, err := signAuditHash(cert.PrivateKey, ""); err != nil {
+			return fmt.Errorf("cannot sign audit records: %v", err)
+		}
+	}
+
+	pkiMu.Lock()
+	defer pkiMu.Unlock()
+
+	// An enforcing TLS profile also applies to a reloaded certificate
+	if serverPolicy != nil && serverPolicy.enforce {
+		if err := serverPolicy.checkCertificate(parsed); err != nil {
+			return err
+		}
+	}
+
+	serverKeyPair = &cert
+	serverCert = parsed
+	serverCRL = crl
+	clientCAs = pool
+	return nil
+}
+
+// loadClientCAs collects the CAs that client certificates are verified
+// against: the -clientca file, the enrollment CA and the issuers bundled
+// after the server certificate. It returns nil if there are none.
+func loadClientCAs(server tls.Certificate) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	found := false
+	if *clientCA != "" {
+		data, err := ioutil.ReadFile(*clientCA)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("no certificate found in " + *clientCA)
+		}
+		found = true
+	}
+	if serverCA != nil {
+		pool.AddCert(serverCA.cert)
+		found = true
+	}
+	for _, der := range server.Certificate[1:] {
+		issuer, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		pool.AddCert(issuer)
+		found = true
+	}
+	if !found {
+		return nil, nil
+	}
+	return pool, nil
+}
+
+// verifyClientChain reports whether a client certificate chains to one of
+// the client CAs, using the other certificates the client sent as
+// intermediates. Anything else in a certificate is only its own claim.
+func verifyClientChain(chain []*x509.Certificate) bool {
+	pool := currentClientCAs()
+	if pool == nil || len(chain) == 0 {
+		return false
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err == nil
+}
+
+// currentClientCAs returns the client CA pool, or nil if there is none.
+func currentClientCAs() *x509.CertPool {
+	pkiMu.RLock()
+	defer pkiMu.RUnlock()
+
+	return clientCAs
+}
+
+// getServerCertificate serves the current key pair to TLS handshakes.
+func getServerCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	pkiMu.RLock()
+	defer pkiMu.RUnlock()
+
+	return serverKeyPair, nil
+}
+
+// currentServerKey returns the server private key.
+func currentServerKey() crypto.PrivateKey {
+	pkiMu.RLock()
+	defer pkiMu.RUnlock()
+
+	return serverKeyPair.PrivateKey
+}
+
+func currentServerCert() *x509.Certificate {
+	pkiMu.RLock()
+	defer pkiMu.RUnlock()
+
+	return serverCert
+}
+
+// revokeSerial revokes a certificate serial number until the server stops,
+// in addition to the CRL.
+func revokeSerial(serial *big.Int) {
+	pkiMu.Lock()
+	defer pkiMu.Unlock()
+
+	revokedSerials[fmt.Sprintf("%X", serial)] = time.Now()
+}
+
+// revocationStatus checks a certificate against the CRL and the serials
+// revoked at runtime.
+func revocationStatus(cert *x509.Certificate) (bool, time.Time) {
+	pkiMu.RLock()
+	defer pkiMu.RUnlock()
+
+	if revokedAt, revoked := revokedSerials[fmt.Sprintf("%X", cert.SerialNumber)]; revoked {
+		return true, revokedAt
+	}
+	if serverCRL != nil {
+		return isCertificateRevoked(cert, serverCRL)
+	}
+	return false, time.Time{}
+}
+
+// parsePrivateKey decodes a PEM private key in PKCS#8, PKCS#1 or SEC 1
+// form, decrypting it first if it is a PKCS#8 "ENCRYPTED PRIVATE KEY" or
+// carries a DEK-Info header.
+func parsePrivateKey(data, password []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM private key found")
+	}
+	der, err := decryptPrivateKeyBlock(block, password)
+	if err != nil {
+		return nil, err
+	}
+	return parsePrivateKeyDER(block.Type, der)
+}
+
+// decryptPrivateKeyBlock returns the DER of a PEM private key, decrypting
+// it if needed.
+func decryptPrivateKeyBlock(block *pem.Block, password []byte) ([]byte, error) {
+	if !IsEncryptedPKCS8Block(block) && !IsEncryptedPEMBlock(block) {
+		return block.Bytes, nil
+	}
+	if len(password) == 0 {
+		return nil, errors.New("private key is encrypted, a password is required")
+	}
+	if IsEncryptedPKCS8Block(block) {
+		return DecryptPKCS8(block.Bytes, password)
+	}
+	return DecryptPEMBlock(block, password)
+}
+
+// parsePrivateKeyDER parses the DER of a PEM block of the given type.
+func parsePrivateKeyDER(blockType string, der []byte) (crypto.Signer, error) {
+	var key interface{}
+	var err error
+	switch blockType {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(der)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(der)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(der)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported private key type")
+	}
+	return signer, nil
+}
+
+// loadPrivateKey loads a private key from a PEM file, a PKCS#11 token
+// ("pkcs11:" URI) or a key agent ("agent:<socket>").
+func loadPrivateKey(path string, password []byte) (crypto.Signer, error) {
+	var key crypto.Signer
+	var err error
+	switch {
+	case strings.HasPrefix(path, "pkcs11:"):
+		key, err = loadPKCS11Key(path, password)
+		path, _, _ = strings.Cut(path, "?") // keep the PIN out of errors
+	case strings.HasPrefix(path, "agent:"):
+		key, err = loadAgentKey(path)
+	default:
+		var data []byte
+		if data, err = ioutil.ReadFile(path); err != nil {
+			return nil, err
+		}
+		key, err = parsePrivateKey(data, password)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return key, nil
+}
+
+// loadKeyPair works like tls.LoadX509KeyPair but also accepts encrypted
+// private keys and keys held by a token or an agent.
+func loadKeyPair(certPath, keyPath string, password []byte) (tls.Certificate, error) {
+	var cert tls.Certificate
+	certPEM, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return cert, err
+	}
+	for {
+		var block *pem.Block
+		if block, certPEM = pem.Decode(certPEM); block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+	if len(cert.Certificate) == 0 {
+		return cert, errors.New("no certificate found in " + certPath)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return cert, err
+	}
+
+	key, err := loadPrivateKey(keyPath, password)
+	if err != nil {
+		return cert, err
+	}
+	certPublic, err := x509.MarshalPKIXPublicKey(cert.Leaf.PublicKey)
+	if err != nil {
+		return cert, err
+	}
+	keyPublic, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return cert, err
+	}
+	if !bytes.Equal(certPublic, keyPublic) {
+		return cert, errors.New("private key does not match the public key in " + certPath)
+	}
+	cert.PrivateKey = key
+	return cert, nil
+}
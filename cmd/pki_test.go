@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert describes a certificate for newTestCert. A nil issuer makes it
+// self-signed.
+type testCert struct {
+	subject string
+	skid    []byte
+	ca      bool
+	issuer  *x509.Certificate
+	signer  crypto.Signer
+	key     crypto.Signer
+	eku     []x509.ExtKeyUsage
+	sigAlg  x509.SignatureAlgorithm
+}
+
+var testSerial int64
+
+// newTestCert creates a certificate, generating a P-256 key unless one is
+// given.
+func newTestCert(t testing.TB, c testCert) (*x509.Certificate, crypto.Signer) {
+	t.Helper()
+	cert, key, err := createTestCert(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// createTestCert creates a certificate, returning any error.
+func createTestCert(c testCert) (*x509.Certificate, crypto.Signer, error) {
+	key := c.key
+	if key == nil {
+		var err error
+		if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			return nil, nil, err
+		}
+	}
+	testSerial++
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(testSerial),
+		Subject:               pkix.Name{CommonName: c.subject},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		SubjectKeyId:          c.skid,
+		BasicConstraintsValid: true,
+		IsCA:                  c.ca,
+		ExtKeyUsage:           c.eku,
+		DNSNames:              []string{"localhost"},
+		SignatureAlgorithm:    c.sigAlg,
+	}
+	if c.ca {
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	} else {
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+	}
+	issuer, signer := template, key
+	if c.issuer != nil {
+		issuer, signer = c.issuer, c.signer
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, key.Public(), signer)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// tlsCertificate bundles certificates as a key pair's chain.
+func tlsCertificate(chain ...*x509.Certificate) tls.Certificate {
+	var cert tls.Certificate
+	for _, c := range chain {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	return cert
+}
+
+// setClientCAs installs a client CA pool for the duration of a test.
+func setClientCAs(t *testing.T, cas ...*x509.Certificate) {
+	t.Helper()
+	var pool *x509.CertPool
+	if len(cas) > 0 {
+		pool = x509.NewCertPool()
+		for _, ca := range cas {
+			pool.AddCert(ca)
+		}
+	}
+	pkiMu.Lock()
+	old := clientCAs
+	clientCAs = pool
+	pkiMu.Unlock()
+	t.Cleanup(func() {
+		pkiMu.Lock()
+		clientCAs = old
+		pkiMu.Unlock()
+	})
+}
+
+func TestVerifyClientChain(t *testing.T) {
+	ca, caKey := newTestCert(t, testCert{subject: "Test CA", ca: true})
+	inter, interKey := newTestCert(t, testCert{subject: "Test Intermediate", ca: true, issuer: ca, signer: caKey})
+	direct, _ := newTestCert(t, testCert{subject: "alice", issuer: ca, signer: caKey, eku: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	chained, _ := newTestCert(t, testCert{subject: "bob", issuer: inter, signer: interKey})
+	serverOnly, _ := newTestCert(t, testCert{subject: "server", issuer: ca, signer: caKey, eku: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}})
+	// A self-signed certificate copying the CA's subject and key ID
+	spoof, spoofKey := newTestCert(t, testCert{subject: "Test CA", skid: ca.SubjectKeyId, ca: true})
+	forged, _ := newTestCert(t, testCert{subject: "alice", skid: direct.SubjectKeyId, issuer: spoof, signer: spoofKey})
+
+	setClientCAs(t)
+	if verifyClientChain([]*x509.Certificate{direct}) {
+		t.Error("verified without client CAs")
+	}
+
+	setClientCAs(t, ca)
+	tests := []struct {
+		name  string
+		chain []*x509.Certificate
+		want  bool
+	}{
+		{"issued by the CA", []*x509.Certificate{direct}, true},
+		{"through an intermediate", []*x509.Certificate{chained, inter}, true},
+		{"intermediate missing", []*x509.Certificate{chained}, false},
+		{"server authentication only", []*x509.Certificate{serverOnly}, false},
+		{"self-signed lookalike CA", []*x509.Certificate{spoof}, false},
+		{"issued by the lookalike", []*x509.Certificate{forged, spoof}, false},
+		{"empty chain", nil, false},
+	}
+	for _, tt := range tests {
+		if got := verifyClientChain(tt.chain); got != tt.want {
+			t.Errorf("%s: verified = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLoadClientCAs(t *testing.T) {
+	ca, caKey := newTestCert(t, testCert{subject: "Test CA", ca: true})
+	server, _ := newTestCert(t, testCert{subject: "server", issuer: ca, signer: caKey})
+	client, _ := newTestCert(t, testCert{subject: "alice", issuer: ca, signer: caKey})
+
+	old := *clientCA
+	defer func() { *clientCA = old }()
+
+	*clientCA = ""
+	pool, err := loadClientCAs(tlsCertificate(server))
+	if err != nil || pool != nil {
+		t.Fatalf("no CAs: pool %v, error %v", pool, err)
+	}
+
+	// An issuer bundled after the server certificate is a client CA
+	pool, err = loadClientCAs(tlsCertificate(server, ca))
+	if err != nil || pool == nil {
+		t.Fatalf("bundled issuer: pool %v, error %v", pool, err)
+	}
+	if _, err := client.Verify(x509.VerifyOptions{Roots: pool}); err != nil {
+		t.Errorf("client does not verify against the bundled issuer: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0600)
+	*clientCA = path
+	pool, err = loadClientCAs(tlsCertificate(server))
+	if err != nil || pool == nil {
+		t.Fatalf("-clientca: pool %v, error %v", pool, err)
+	}
+	if _, err := client.Verify(x509.VerifyOptions{Roots: pool}); err != nil {
+		t.Errorf("client does not verify against -clientca: %v", err)
+	}
+
+	os.WriteFile(path, []byte("not a certificate"), 0600)
+	if _, err := loadClientCAs(tlsCertificate(server)); err == nil {
+		t.Error("accepted a -clientca file without certificates")
+	}
+}
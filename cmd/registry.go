@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Size of each client's outbound message queue
+const clientQueueSize = 256
+
+type Client struct {
+	conn       net.Conn
+	username   string
+	clientCert *x509.Certificate
+	identity   string
+	keyID      string
+	id         uint64
+	since      time.Time
+	oper       bool
+	verified   bool // the certificate chains to a client CA
+	out        chan string
+
+	// mu guards username, rooms, closed, muteNotices and dropped
+	mu          sync.Mutex
+	rooms       []*Room
+	closed      bool
+	muteNotices bool
+	dropped     uint64 // messages dropped since the queue last had room
+}
+
+type Room struct {
+	name      string
+	clients   []*Client
+	owner     string
+	permanent bool // set by -rooms
+	closed    bool // removed from the registry when it was left empty
+	mu        sync.Mutex
+}
+
+// registry holds the server state shared by all client goroutines: the
+// connected clients, their sessions grouped by key ID, the nicknames and
+// the chat rooms.
+//
+// Locks are always taken in the order registry.mu, Room.mu, Client.mu.
+type registry struct {
+	mu       sync.Mutex
+	lastID   uint64
+	clients  map[*Client]bool
+	sessions map[string][]*Client
+	nicks    map[string]string
+	rooms    map[string]*Room
+}
+
+var hub = newRegistry()
+
+func newRegistry() *registry {
+	return &registry{
+		clients:  make(map[*Client]bool),
+		sessions: make(map[string][]*Client),
+		nicks:    make(map[string]string),
+		rooms:    make(map[string]*Room),
+	}
+}
+
+func newClient(conn net.Conn, username string, cert *x509.Certificate, keyID string) *Client {
+	return &Client{
+		conn:       conn,
+		username:   username,
+		clientCert: cert,
+		keyID:      keyID,
+		out:        make(chan string, clientQueueSize),
+	}
+}
+
+// send queues a message for the client without blocking the caller. The
+// message is dropped if the client is gone or its queue is full. Only the
+// first drop of a run is logged, and the count once the queue has room
+// again; the total is in the dropped messages counter.
+func (c *Client) send(message string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+	select {
+	case c.out <- message:
+		if c.dropped > 0 {
+			logWarn("outbound queue recovered", "user", c.username, "dropped", c.dropped)
+			c.dropped = 0
+		}
+	default:
+		atomic.AddUint64(&messagesDropped, 1)
+		if c.dropped == 0 {
+			logWarn("outbound queue full, dropping messages", "user", c.username)
+		}
+		c.dropped++
+	}
+}
+
+// writeLoop delivers queued messages until the client is closed, then
+// closes the connection.
+func (c *Client) writeLoop() {
+	defer c.conn.Close()
+
+	for message := range c.out {
+		if _, err := c.conn.Write([]byte(message)); err != nil {
+			logWarn("error sending message to client", "user", c.name(), "error", err)
+			return
+		}
+	}
+}
+
+// close stops accepting messages for the client. It is safe to call more
+// than once.
+func (c *Client) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		close(c.out)
+	}
+}
+
+// name returns the client's current "@nick" username.
+func (c *Client) name() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.username
+}
+
+// setMuteNotices turns the server-wide join/part notices off or on for the
+// client.
+func (c *Client) setMuteNotices(mute bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.muteNotices = mute
+}
+
+func (c *Client) noticesMuted() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.muteNotices
+}
+
+// joinedRooms returns a snapshot of the rooms the client is in, oldest first.
+func (c *Client) joinedRooms() []*Room {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]*Room(nil), c.rooms...)
+}
+
+// members returns a snapshot of the clients in the room.
+func (room *Room) members() []*Client {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	return append([]*Client(nil), room.clients...)
+}
+
+// Reasons register refuses a session
+var (
+	errSessionLimit = errors.New("session limit reached")
+	errKeyIDClash   = errors.New("key ID in use by another certificate")
+)
+
+// register adds a client to the registry, allowing at most maxSessions
+// sessions per key ID, all of the same certificate holder. Sessions of the
+// same key ID share one username; a new identity whose username is taken
+// gets a numeric suffix to make it unique.
+func (r *registry) register(client *Client, maxSessions int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if sessions := r.sessions[client.keyID]; len(sessions) > 0 {
+		if !sameHolder(sessions[0], client) {
+			return errKeyIDClash
+		}
+		if len(sessions) >= maxSessions {
+			return errSessionLimit
+		}
+		client.username = sessions[0].name()
+	} else {
+		base := client.username
+		for i := 2; r.nicks[strings.ToLower(client.username)] != ""; i++ {
+			client.username = fmt.Sprintf("%s_%d", base, i)
+		}
+		r.nicks[strings.ToLower(client.username)] = client.keyID
+	}
+	r.lastID++
+	client.id = r.lastID
+	client.since = time.Now()
+	r.sessions[client.keyID] = append(r.sessions[client.keyID], client)
+	r.clients[client] = true
+	return nil
+}
+
+// sameHolder reports whether two sessions with one key ID belong to the
+// same certificate holder: they use the same public key, or both have a
+// chain verified against the client CAs. A key ID alone proves nothing, as
+// it can be copied into any self-signed certificate.
+func sameHolder(a, b *Client) bool {
+	return bytes.Equal(a.clientCert.RawSubjectPublicKeyInfo, b.clientCert.RawSubjectPublicKeyInfo) ||
+		(a.verified && b.verified)
+}
+
+// rename changes the username of all sessions sharing the client's key ID,
+// failing if another identity already uses it.
+func (r *registry) rename(client *Client, username string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if owner, ok := r.nicks[strings.ToLower(username)]; ok && owner != client.keyID {
+		return errors.New("nickname " + username + " is already in use")
+	}
+	delete(r.nicks, strings.ToLower(client.username))
+	for _, session := range r.sessions[client.keyID] {
+		session.mu.Lock()
+		session.username = username
+		session.mu.Unlock()
+	}
+	r.nicks[strings.ToLower(username)] = client.keyID
+	return nil
+}
+
+// findClient returns the oldest session using the given username, with
+// or without the "@" prefix.
+func (r *registry) findClient(username string) *Client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	keyID, ok := r.nicks[strings.ToLower("@"+strings.TrimPrefix(username, "@"))]
+	if !ok || len(r.sessions[keyID]) == 0 {
+		return nil
+	}
+	return r.sessions[keyID][0]
+}
+
+// sessionsOf returns a snapshot of all sessions sharing the client's key ID,
+// oldest first.
+func (r *registry) sessionsOf(keyID string) []*Client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]*Client(nil), r.sessions[keyID]...)
+}
+
+// unregister closes the client, removes it from every room and forgets it.
+// It is safe to call more than once.
+func (r *registry) unregister(client *Client) {
+	client.close()
+	rooms := client.joinedRooms()
+	removeClient(client)
+	for _, room := range rooms {
+		r.removeRoomIfEmpty(room)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.clients[client] {
+		return
+	}
+	delete(r.clients, client)
+
+	sessions := r.sessions[client.keyID]
+	for i, c := range sessions {
+		if c == client {
+			sessions = append(sessions[:i], sessions[i+1:]...)
+			break
+		}
+	}
+	if len(sessions) == 0 {
+		delete(r.sessions, client.keyID)
+		delete(r.nicks, strings.ToLower(client.username))
+	} else {
+		r.sessions[client.keyID] = sessions
+	}
+}
+
+// connected returns a snapshot of every registered client.
+func (r *registry) connected() []*Client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := make([]*Client, 0, len(r.clients))
+	for client := range r.clients {
+		list = append(list, client)
+	}
+	return list
+}
+
+func (r *registry) findRoom(roomName string) *Room {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.rooms[roomName]
+}
+
+// findOrCreateRoom returns the named room, creating it if create is set.
+// It returns nil for a room that does not exist and may not be created.
+func (r *registry) findOrCreateRoom(roomName string, create bool) *Room {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	room, ok := r.rooms[roomName]
+	if !ok && create {
+		room = &Room{
+			name:    roomName,
+			clients: make([]*Client, 0),
+		}
+		r.rooms[roomName] = room
+	}
+	return room
+}
+
+// removeRoomIfEmpty forgets a room that has no members left, unless it
+// is one of the -rooms, along with its owner and its metrics series. A
+// client still holding the room sees it closed when joining it.
+func (r *registry) removeRoomIfEmpty(room *Room) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	if len(room.clients) > 0 || room.permanent || r.rooms[room.name] != room {
+		return
+	}
+	delete(r.rooms, room.name)
+	room.closed = true
+}
+
+// roomList returns a snapshot of the rooms sorted by name.
+func (r *registry) roomList() []*Room {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := make([]*Room, 0, len(r.rooms))
+	for _, room := range r.rooms {
+		list = append(list, room)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	return list
+}
+
+// broadcast sends a message to every connected client.
+func (r *registry) broadcast(message string) {
+	for _, client := range r.connected() {
+		client.send(message)
+	}
+}
+
+// notice sends a server-wide join/part notice to every connected client
+// that has not muted them.
+func (r *registry) notice(message string) {
+	for _, client := range r.connected() {
+		if !client.noticesMuted() {
+			client.send(message)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// pipeClient is a client connected through net.Pipe, whose peer end
+// collects every line the server writes to it.
+type pipeClient struct {
+	*Client
+	mu    sync.Mutex
+	lines []string
+	done  chan struct{}
+}
+
+func newPipeClient(t *testing.T, username, keyID string) *pipeClient {
+	t.Helper()
+	server, peer := net.Pipe()
+	pc := &pipeClient{
+		Client: newClient(server, username, &x509.Certificate{}, keyID),
+		done:   make(chan struct{}),
+	}
+	go pc.writeLoop()
+	go func() {
+		defer close(pc.done)
+		scanner := bufio.NewScanner(peer)
+		for scanner.Scan() {
+			pc.mu.Lock()
+			pc.lines = append(pc.lines, scanner.Text())
+			pc.mu.Unlock()
+		}
+	}()
+	t.Cleanup(func() { peer.Close() })
+	return pc
+}
+
+// received waits for the connection to close and returns what was read.
+func (pc *pipeClient) received() []string {
+	<-pc.done
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.lines
+}
+
+func TestRegistryConcurrentClients(t *testing.T) {
+	const clients, rooms = 300, 7
+	r := newRegistry()
+
+	var wg sync.WaitGroup
+	pipes := make([]*pipeClient, clients)
+	for i := range pipes {
+		pipes[i] = newPipeClient(t, "@user", fmt.Sprintf("KEY%03d", i))
+	}
+	for i, pc := range pipes {
+		wg.Add(1)
+		go func(i int, pc *pipeClient) {
+			defer wg.Done()
+			if r.register(pc.Client, 1) != nil {
+				t.Errorf("client %d: registration refused", i)
+				return
+			}
+			home := r.findOrCreateRoom(fmt.Sprintf("#room%d", i%rooms), true)
+			other := r.findOrCreateRoom(fmt.Sprintf("#room%d", (i+1)%rooms), true)
+			joinRoom(pc.Client, home)
+			joinRoom(pc.Client, other)
+			sendMessage(pc.Client, home, "hello")
+			r.broadcast(fmt.Sprintf("broadcast from %d\n", i))
+			leaveRoom(pc.Client, other)
+			if r.findClient(pc.name()) == nil {
+				t.Errorf("client %d: %s not found", i, pc.name())
+			}
+			r.connected()
+			r.roomList()
+			r.unregister(pc.Client)
+		}(i, pc)
+	}
+	wg.Wait()
+
+	for _, pc := range pipes {
+		pc.received()
+	}
+	if n := len(r.connected()); n != 0 {
+		t.Errorf("%d clients still connected", n)
+	}
+	if len(r.sessions) != 0 || len(r.nicks) != 0 {
+		t.Errorf("sessions or nicknames left over: %v %v", r.sessions, r.nicks)
+	}
+	for _, room := range r.roomList() {
+		if n := len(room.members()); n != 0 {
+			t.Errorf("%s still has %d members", room.name, n)
+		}
+	}
+}
+
+func TestRegisterUniqueNicknames(t *testing.T) {
+	const clients = 200
+	r := newRegistry()
+
+	var wg sync.WaitGroup
+	pipes := make([]*pipeClient, clients)
+	for i := range pipes {
+		pipes[i] = newPipeClient(t, "@same", fmt.Sprintf("KEY%03d", i))
+		wg.Add(1)
+		go func(pc *pipeClient) {
+			defer wg.Done()
+			r.register(pc.Client, 1)
+		}(pipes[i])
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	for _, pc := range pipes {
+		name := pc.name()
+		if seen[name] {
+			t.Errorf("nickname %s given twice", name)
+		}
+		seen[name] = true
+		if found := r.findClient(name); found != pc.Client {
+			t.Errorf("%s resolves to the wrong client", name)
+		}
+	}
+	for _, pc := range pipes {
+		r.unregister(pc.Client)
+	}
+}
+
+func TestRegisterSessionLimit(t *testing.T) {
+	const attempts, limit = 100, 3
+	r := newRegistry()
+
+	var wg sync.WaitGroup
+	var accepted int32
+	pipes := make([]*pipeClient, attempts)
+	for i := range pipes {
+		pipes[i] = newPipeClient(t, fmt.Sprintf("@nick%d", i), "SAMEKEY")
+		wg.Add(1)
+		go func(pc *pipeClient) {
+			defer wg.Done()
+			if r.register(pc.Client, limit) == nil {
+				atomic.AddInt32(&accepted, 1)
+			}
+		}(pipes[i])
+	}
+	wg.Wait()
+
+	if accepted != limit {
+		t.Fatalf("accepted %d sessions, want %d", accepted, limit)
+	}
+	sessions := r.sessionsOf("SAMEKEY")
+	for _, session := range sessions {
+		if session.name() != sessions[0].name() {
+			t.Errorf("sessions named %s and %s", session.name(), sessions[0].name())
+		}
+	}
+	for _, pc := range pipes {
+		r.unregister(pc.Client)
+	}
+	if len(r.nicks) != 0 {
+		t.Errorf("nicknames left over: %v", r.nicks)
+	}
+}
+
+func TestBroadcastReachesEveryClient(t *testing.T) {
+	const clients = 250
+	r := newRegistry()
+
+	pipes := make([]*pipeClient, clients)
+	for i := range pipes {
+		pipes[i] = newPipeClient(t, fmt.Sprintf("@user%d", i), fmt.Sprintf("KEY%03d", i))
+		r.register(pipes[i].Client, 1)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r.broadcast(fmt.Sprintf("message %d\n", i))
+		}(i)
+	}
+	wg.Wait()
+	for _, pc := range pipes {
+		r.unregister(pc.Client)
+	}
+
+	for _, pc := range pipes {
+		lines := pc.received()
+		if len(lines) != 10 {
+			t.Fatalf("%s received %d messages, want 10", pc.name(), len(lines))
+		}
+		for _, line := range lines {
+			if !strings.HasPrefix(line, "message ") {
+				t.Errorf("%s received %q", pc.name(), line)
+			}
+		}
+	}
+}
+
+func TestRoomMessagesStayInRoom(t *testing.T) {
+	r := newRegistry()
+	alice := newPipeClient(t, "@alice", "KEYA")
+	bob := newPipeClient(t, "@bob", "KEYB")
+	carol := newPipeClient(t, "@carol", "KEYC")
+	for _, pc := range []*pipeClient{alice, bob, carol} {
+		r.register(pc.Client, 1)
+	}
+
+	room := r.findOrCreateRoom("#test", true)
+	joinRoom(alice.Client, room)
+	joinRoom(bob.Client, room)
+	joinRoom(carol.Client, r.findOrCreateRoom("#other", true))
+	sendMessage(alice.Client, room, "hi bob")
+	for _, pc := range []*pipeClient{alice, bob, carol} {
+		r.unregister(pc.Client)
+	}
+
+	if !contains(bob.received(), "[#test] @alice# hi bob") {
+		t.Errorf("bob did not receive the message: %q", bob.received())
+	}
+	for _, pc := range []*pipeClient{alice, carol} {
+		for _, line := range pc.received() {
+			if strings.Contains(line, "hi bob") {
+				t.Errorf("%s received %q", pc.name(), line)
+			}
+		}
+	}
+}
+
+func TestSendDropsWhenQueueFull(t *testing.T) {
+	server, peer := net.Pipe()
+	defer server.Close()
+	defer peer.Close()
+	client := newClient(server, "@slow", &x509.Certificate{}, "KEYS")
+
+	before := atomic.LoadUint64(&messagesDropped)
+	for i := 0; i < clientQueueSize+10; i++ {
+		client.send("line\n")
+	}
+	if dropped := atomic.LoadUint64(&messagesDropped) - before; dropped != 10 {
+		t.Errorf("dropped %d messages, want 10", dropped)
+	}
+	if client.dropped != 10 {
+		t.Errorf("client counted %d drops, want 10", client.dropped)
+	}
+
+	<-client.out
+	client.send("line\n")
+	if client.dropped != 0 {
+		t.Errorf("drop count not reset once the queue had room")
+	}
+
+	client.close()
+	client.send("after close\n")
+	if dropped := atomic.LoadUint64(&messagesDropped) - before; dropped != 10 {
+		t.Errorf("send after close counted as dropped")
+	}
+}
+
+func TestSessionsNeedSameKey(t *testing.T) {
+	setFlag(t, "keyid", "skid")
+	victimCert, _ := newTestCert(t, testCert{subject: "alice", skid: []byte{9, 9, 9, 9}})
+	spoofCert, _ := newTestCert(t, testCert{subject: "alice", skid: victimCert.SubjectKeyId})
+	keyID := clientKeyID(victimCert)
+	if clientKeyID(spoofCert) != keyID {
+		t.Fatal("test certificates do not share the key ID")
+	}
+
+	r := newRegistry()
+	if err := r.register(newClient(nil, "@alice", victimCert, keyID), 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.register(newClient(nil, "@alice", victimCert, keyID), 3); err != nil {
+		t.Errorf("second session of the same key: %v", err)
+	}
+	if err := r.register(newClient(nil, "@mallory", spoofCert, keyID), 3); err != errKeyIDClash {
+		t.Errorf("another key with the same key ID: %v", err)
+	}
+	if n := len(r.sessionsOf(keyID)); n != 2 {
+		t.Errorf("%d sessions, want 2", n)
+	}
+
+	// Certificates verified against the client CAs may share a key ID
+	r = newRegistry()
+	victim, renewed := newClient(nil, "@alice", victimCert, keyID), newClient(nil, "@alice", spoofCert, keyID)
+	victim.verified, renewed.verified = true, true
+	r.register(victim, 3)
+	if err := r.register(renewed, 3); err != nil {
+		t.Errorf("verified certificates with the same key ID: %v", err)
+	}
+}
+
+func TestReplaceSessionNeedsSameKey(t *testing.T) {
+	captureLog(t, levelInfo, "logfmt", privacyStandard)
+	setFlag(t, "keyid", "skid")
+	server := setTestServer(t)
+	savedReplace, savedMax := replaceSessions, maxSessions
+	replaceSessions, maxSessions = true, 1
+	defer func() { replaceSessions, maxSessions = savedReplace, savedMax }()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	victim := testCert{subject: "victim", skid: []byte{7, 7, 7, 7}, key: key}
+	alice := connectCert(t, server, victim)
+	alice.send("JOIN #replace")
+	alice.expect("Joined room")
+
+	spoof := connectCert(t, server, testCert{subject: "victim", skid: victim.skid})
+	spoof.expect("Another certificate is logged in with the same key ID")
+	alice.send("JOIN #still-here")
+	alice.expect("Joined room")
+
+	// The holder of the key replaces its own session
+	again := connectCert(t, server, victim)
+	alice.expect("replaced by a new login")
+	again.send("JOIN #replace")
+	again.expect("Joined room")
+	again.quit()
+}
+
+func TestRoomPolicy(t *testing.T) {
+	captureLog(t, levelInfo, "logfmt", privacyStandard)
+	server := setTestServer(t)
+	setFlag(t, "roomcreate", "opers")
+	setFlag(t, "rooms", "#policy-lobby")
+	setFlag(t, "roomsize", "1")
+	openPermanentRooms()
+
+	alice := connectSession(t, server, "policy-alice")
+	bob := connectSession(t, server, "policy-bob")
+	alice.send("JOIN #policy-new")
+	alice.expect("Only operators can create rooms")
+	if hub.findRoom("#policy-new") != nil {
+		t.Error("room created by a user")
+	}
+
+	alice.send("JOIN #policy-lobby")
+	alice.expect("Joined room: #policy-lobby")
+	bob.send("JOIN #policy-lobby")
+	bob.expect("Room #policy-lobby is full")
+	alice.send("LEAVE #policy-lobby")
+	alice.expect("Left room")
+	bob.send("JOIN #policy-lobby")
+	bob.expect("Joined room: #policy-lobby")
+	alice.quit()
+	bob.quit()
+}
+
+func TestEmptyRoomsAreRemoved(t *testing.T) {
+	captureLog(t, levelInfo, "logfmt", privacyStandard)
+	server := setTestServer(t)
+	setFlag(t, "rooms", "#empty-lobby")
+	openPermanentRooms()
+
+	metrics := func() string {
+		w := httptest.NewRecorder()
+		serveMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+		return w.Body.String()
+	}
+
+	alice := connectSession(t, server, "empty-alice")
+	bob := connectSession(t, server, "empty-bob")
+	alice.send("JOIN #empty-left")
+	alice.expect("Joined room")
+	alice.send("JOIN #empty-quit")
+	alice.expect("Joined room")
+	bob.send("JOIN #empty-quit")
+	bob.expect("Joined room")
+	alice.send("JOIN #empty-lobby")
+	alice.expect("Joined room")
+	if !strings.Contains(metrics(), `room="#empty-left"`) {
+		t.Fatal("no metrics for a room in use")
+	}
+
+	alice.send("LEAVE #empty-left")
+	alice.expect("Left room")
+	alice.quit()
+	if hub.findRoom("#empty-left") != nil {
+		t.Error("room kept after its last member left")
+	}
+	if hub.findRoom("#empty-quit") == nil {
+		t.Error("room removed with a member left")
+	}
+	bob.quit()
+	if hub.findRoom("#empty-quit") != nil {
+		t.Error("room kept after its last member quit")
+	}
+	if hub.findRoom("#empty-lobby") == nil {
+		t.Error("permanent room removed")
+	}
+	if m := metrics(); strings.Contains(m, `room="#empty-left"`) || strings.Contains(m, `room="#empty-quit"`) {
+		t.Errorf("metrics kept for removed rooms:\n%s", m)
+	}
+}
+
+func contains(lines []string, want string) bool {
+	for _, line := range lines {
+		if line == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package main
+
+import "strings"
+
+// permanentRooms returns the rooms named by -rooms.
+func permanentRooms() []string {
+	var names []string
+	for _, name := range strings.Split(*permRooms, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// openPermanentRooms creates the -rooms rooms, which are never removed.
+func openPermanentRooms() {
+	for _, name := range permanentRooms() {
+		room := hub.findOrCreateRoom(name, true)
+		room.mu.Lock()
+		room.permanent = true
+		room.mu.Unlock()
+	}
+}
+
+// enterRoom joins every session of the client to the named room. It
+// returns false if the room does not exist and the client may not create
+// it.
+func enterRoom(client *Client, roomName string) bool {
+	for {
+		room := hub.findOrCreateRoom(roomName, mayCreateRoom(client))
+		if room == nil {
+			return false
+		}
+		// A room left empty meanwhile is gone, and looked up again
+		if !joinRoom(client, room) {
+			continue
+		}
+		for _, session := range hub.sessionsOf(client.keyID) {
+			if session != client {
+				joinRoom(session, room)
+			}
+		}
+		return true
+	}
+}
+
+// mayCreateRoom reports whether the client may create a room by joining
+// it, under the -roomcreate policy.
+func mayCreateRoom(client *Client) bool {
+	return *roomCreate == "any" || client.oper
+}
+
+// roomFull reports whether the room has no place left for the client
+// under the -roomsize limit. Other sessions of a member always fit. The
+// room must be locked.
+func roomFull(room *Room, client *Client) bool {
+	if *roomSize == 0 || hasSession(room, client) {
+		return false
+	}
+	members := make(map[string]bool)
+	for _, c := range room.clients {
+		members[c.keyID] = true
+	}
+	return len(members) >= *roomSize
+}
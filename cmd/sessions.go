@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Session policy set from the -sessions flag
+var (
+	replaceSessions = false
+	maxSessions     = 1
+)
+
+// parseSessionPolicy parses the -sessions flag into whether a new login
+// replaces the existing sessions and how many concurrent sessions a
+// certificate may have.
+func parseSessionPolicy(policy string) (bool, int, error) {
+	switch policy {
+	case "reject":
+		return false, 1, nil
+	case "replace":
+		return true, 1, nil
+	}
+	n, err := strconv.Atoi(policy)
+	if err != nil || n < 1 {
+		return false, 0, errors.New("invalid session policy: " + policy)
+	}
+	return false, n, nil
+}
+
+// listSessions describes all sessions sharing the client's certificate.
+func listSessions(client *Client) string {
+	list := "Sessions of " + client.name() + ":\n"
+	for _, session := range hub.sessionsOf(client.keyID) {
+		list += fmt.Sprintf("- %d %s since %s", session.id, session.conn.RemoteAddr(), session.since.Format("2006-01-02 15:04:05"))
+		if session == client {
+			list += " (this session)"
+		}
+		list += "\n"
+	}
+	return list
+}
+
+// killSession terminates one of the client's own sessions by id.
+func killSession(client *Client, id uint64) bool {
+	for _, session := range hub.sessionsOf(client.keyID) {
+		if session.id == id {
+			session.send("Your session was terminated from another session.\n")
+			hub.unregister(session)
+			return true
+		}
+	}
+	return false
+}
+
+// rateLimiter allows up to limit lines per second from one session. A
+// limit of 0 allows everything.
+type rateLimiter struct {
+	limit  int
+	window time.Time
+	count  int
+}
+
+func (r *rateLimiter) allow() bool {
+	if r.limit <= 0 {
+		return true
+	}
+	if now := time.Now(); now.Sub(r.window) >= time.Second {
+		r.window, r.count = now, 0
+	}
+	r.count++
+	return r.count <= r.limit
+}
@@ -0,0 +1,25 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"net"
+	"os"
+)
+
+// listenPrivate listens on a Unix socket that only the owner can connect
+// to.
+func listenPrivate(path string) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
@@ -0,0 +1,42 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// listenPrivate listens on a Unix socket that only the owner can connect
+// to. The socket is bound and made private inside a new directory that
+// only the owner can enter, and then linked at path, so that it is never
+// accessible to others, not even until a chmod.
+func listenPrivate(path string) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".ircs-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	private := filepath.Join(dir, "sock")
+	listener, err := net.Listen("unix", private)
+	if err != nil {
+		return nil, err
+	}
+	// The bound name goes with the directory, path is removed by its owner
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(private, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	// Unlike a rename, a link never replaces a file created at path since
+	if err := os.Link(private, path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
@@ -0,0 +1,69 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestListenPrivate(t *testing.T) {
+	mask := syscall.Umask(0)
+	defer syscall.Umask(mask)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ircs.sock")
+	listener, err := listenPrivate(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		t.Fatalf("%s is not a socket: %v", path, info.Mode())
+	}
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		t.Errorf("socket created with mode %o", perm)
+	}
+	if restored := syscall.Umask(0); restored != 0 {
+		t.Errorf("umask changed to %o", restored)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("files left next to the socket: %v", entries)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// A socket left by an earlier run is replaced
+	listener.Close()
+	again, err := listenPrivate(path)
+	if err != nil {
+		t.Fatalf("stale socket: %v", err)
+	}
+	again.Close()
+}
+
+func TestListenPrivateKeepsOtherFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ircs.sock")
+	if err := os.WriteFile(path, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if listener, err := listenPrivate(path); err == nil {
+		listener.Close()
+		t.Fatal("listened over a regular file")
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "data" {
+		t.Errorf("regular file changed: %q, %v", data, err)
+	}
+}
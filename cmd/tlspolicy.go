@@ -0,0 +1,346 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// GOST cipher suites (RFC 9189 for TLS 1.2, RFC 9367 for TLS 1.3)
+var gostCipherSuites = map[string]uint16{
+	"TLS_GOSTR341112_256_WITH_KUZNYECHIK_CTR_OMAC": 0xC100,
+	"TLS_GOSTR341112_256_WITH_MAGMA_CTR_OMAC":      0xC101,
+	"TLS_GOSTR341112_256_WITH_KUZNYECHIK_MGM_L":    0xC103,
+	"TLS_GOSTR341112_256_WITH_MAGMA_MGM_L":         0xC104,
+	"TLS_GOSTR341112_256_WITH_KUZNYECHIK_MGM_S":    0xC105,
+	"TLS_GOSTR341112_256_WITH_MAGMA_MGM_S":         0xC106,
+}
+
+// Key exchange groups accepted by -tlscurves
+var curveIDs = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P-256":  tls.CurveP256,
+	"P-384":  tls.CurveP384,
+	"P-521":  tls.CurveP521,
+	"GC256A": 0x0022,
+	"GC256B": 0x0023,
+	"GC256C": 0x0024,
+	"GC256D": 0x0025,
+	"GC512A": 0x0026,
+	"GC512B": 0x0027,
+	"GC512C": 0x0028,
+}
+
+// Certificate signature algorithms accepted by -tlssigalgs. They apply to
+// the certificates a peer presents, not to the handshake signature.
+var sigAlgOIDs = map[string]asn1.ObjectIdentifier{
+	"rsa-sha1":     {1, 2, 840, 113549, 1, 1, 5},
+	"rsa-sha256":   {1, 2, 840, 113549, 1, 1, 11},
+	"rsa-sha384":   {1, 2, 840, 113549, 1, 1, 12},
+	"rsa-sha512":   {1, 2, 840, 113549, 1, 1, 13},
+	"rsa-pss":      {1, 2, 840, 113549, 1, 1, 10},
+	"ecdsa-sha1":   {1, 2, 840, 10045, 4, 1},
+	"ecdsa-sha256": {1, 2, 840, 10045, 4, 3, 2},
+	"ecdsa-sha384": {1, 2, 840, 10045, 4, 3, 3},
+	"ecdsa-sha512": {1, 2, 840, 10045, 4, 3, 4},
+	"ed25519":      {1, 3, 101, 112},
+	"gost2012-256": {1, 2, 643, 7, 1, 1, 3, 2},
+	"gost2012-512": {1, 2, 643, 7, 1, 1, 3, 3},
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// profileDefaults is a named set of defaults for the TLS policy flags.
+// Enforcing profiles also refuse a local certificate outside the policy.
+type profileDefaults struct {
+	minVersion, maxVersion string
+	ciphers, curves        string
+	sigAlgs                string
+	enforce                bool
+}
+
+var tlsProfiles = map[string]profileDefaults{
+	"modern": {
+		minVersion: "1.3",
+		maxVersion: "1.3",
+		ciphers:    "", // every TLS 1.3 suite of the TLS stack
+		curves:     "", // every group the TLS stack supports
+		sigAlgs: "ed25519,ecdsa-sha256,ecdsa-sha384,ecdsa-sha512,rsa-pss,rsa-sha256,rsa-sha384,rsa-sha512," +
+			"gost2012-256,gost2012-512",
+	},
+	"gost-only": {
+		minVersion: "1.2",
+		maxVersion: "1.3",
+		ciphers: "TLS_GOSTR341112_256_WITH_KUZNYECHIK_MGM_L,TLS_GOSTR341112_256_WITH_MAGMA_MGM_L," +
+			"TLS_GOSTR341112_256_WITH_KUZNYECHIK_MGM_S,TLS_GOSTR341112_256_WITH_MAGMA_MGM_S," +
+			"TLS_GOSTR341112_256_WITH_KUZNYECHIK_CTR_OMAC,TLS_GOSTR341112_256_WITH_MAGMA_CTR_OMAC",
+		curves:  "GC256A,GC256B,GC256C,GC256D,GC512A,GC512B,GC512C",
+		sigAlgs: "gost2012-256,gost2012-512",
+		enforce: true,
+	},
+	"compat": {
+		minVersion: "1.2",
+		maxVersion: "1.3",
+		ciphers:    "", // every suite the TLS stack considers secure
+		curves:     "", // every group the TLS stack supports
+		sigAlgs: "ed25519,ecdsa-sha256,ecdsa-sha384,ecdsa-sha512,ecdsa-sha1,rsa-pss,rsa-sha256,rsa-sha384,rsa-sha512,rsa-sha1," +
+			"gost2012-256,gost2012-512",
+	},
+}
+
+// tlsPolicy is the effective TLS policy built from -tlsprofile and the
+// flags overriding it.
+type tlsPolicy struct {
+	profile                string
+	minVersion, maxVersion uint16
+	ciphers                []uint16
+	curves                 []tls.CurveID
+	sigAlgs                []string
+	enforce                bool
+}
+
+// TLS policy of the running server, checked when the certificate is reloaded
+var serverPolicy *tlsPolicy
+
+// newTLSPolicy builds the TLS policy from the flags.
+func newTLSPolicy() (*tlsPolicy, error) {
+	profile, ok := tlsProfiles[*tlsProfile]
+	if !ok {
+		return nil, configError("tlsprofile", errors.New("unknown TLS profile: "+*tlsProfile))
+	}
+	policy := &tlsPolicy{profile: *tlsProfile, enforce: profile.enforce}
+
+	var err error
+	if policy.minVersion, err = parseTLSVersion(*tlsMinVer, profile.minVersion); err != nil {
+		return nil, configError("tlsmin", err)
+	}
+	if policy.maxVersion, err = parseTLSVersion(*tlsMaxVer, profile.maxVersion); err != nil {
+		return nil, configError("tlsmax", err)
+	}
+	if policy.minVersion > policy.maxVersion {
+		return nil, configError("tlsmin", errors.New("minimum TLS version is above the maximum"))
+	}
+
+	for _, name := range policyList(*tlsCiphers, profile.ciphers) {
+		id, ok := cipherSuiteID(name)
+		if !ok {
+			return nil, configError("tlsciphers", errors.New("unknown cipher suite: "+name))
+		}
+		policy.ciphers = append(policy.ciphers, id)
+	}
+	for _, name := range policyList(*tlsCurves, profile.curves) {
+		curve, ok := curveIDs[name]
+		if !ok {
+			return nil, configError("tlscurves", errors.New("unknown curve: "+name))
+		}
+		policy.curves = append(policy.curves, curve)
+	}
+	for _, name := range policyList(*tlsSigAlgs, profile.sigAlgs) {
+		if _, ok := sigAlgOIDs[name]; !ok {
+			return nil, configError("tlssigalgs", errors.New("unknown signature algorithm: "+name))
+		}
+		policy.sigAlgs = append(policy.sigAlgs, name)
+	}
+	return policy, nil
+}
+
+func parseTLSVersion(value, profileDefault string) (uint16, error) {
+	if value == "" {
+		value = profileDefault
+	}
+	version, ok := tlsVersions[value]
+	if !ok {
+		return 0, errors.New("unknown TLS version: " + value)
+	}
+	return version, nil
+}
+
+// policyList splits a comma-separated flag value, falling back to the
+// profile default when the flag is empty.
+func policyList(value, profileDefault string) []string {
+	if value == "" {
+		value = profileDefault
+	}
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func cipherSuiteID(name string) (uint16, bool) {
+	if id, ok := gostCipherSuites[name]; ok {
+		return id, true
+	}
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
+
+// apply configures a client or server tls.Config with the policy. Cipher
+// suites and certificate signature algorithms are also checked after the
+// handshake, since TLS 1.3 suites cannot be restricted up front. The
+// handshake signature schemes are left to crypto/tls, which offers no
+// setting for them, so -tlssigalgs only covers certificates.
+func (p *tlsPolicy) apply(config *tls.Config) {
+	config.MinVersion = p.minVersion
+	config.MaxVersion = p.maxVersion
+	config.CipherSuites = p.ciphers
+	config.CurvePreferences = p.curves
+	config.VerifyConnection = p.verify
+}
+
+// verify rejects a connection that negotiated a cipher suite, or whose
+// peer presented a certificate signed with an algorithm, outside the
+// policy.
+func (p *tlsPolicy) verify(state tls.ConnectionState) error {
+	if len(p.ciphers) > 0 {
+		allowed := false
+		for _, id := range p.ciphers {
+			allowed = allowed || id == state.CipherSuite
+		}
+		if !allowed {
+			return fmt.Errorf("cipher suite %s is not allowed by the %s TLS policy", cipherSuiteName(state.CipherSuite), p.profile)
+		}
+	}
+	for _, cert := range state.PeerCertificates {
+		if err := p.checkCertificate(cert); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkCertificate rejects a certificate whose signature algorithm is
+// outside the policy.
+func (p *tlsPolicy) checkCertificate(cert *x509.Certificate) error {
+	oid, err := certSignatureOID(cert)
+	if err != nil {
+		return err
+	}
+	for _, name := range p.sigAlgs {
+		if sigAlgOIDs[name].Equal(oid) {
+			return nil
+		}
+	}
+	return fmt.Errorf("certificate signature algorithm %s is not allowed by the %s TLS policy", sigAlgName(oid), p.profile)
+}
+
+// checkLocalCertificate checks our own certificate against the policy. A
+// mismatch is an error under an enforcing profile and a warning otherwise.
+func (p *tlsPolicy) checkLocalCertificate(cert *x509.Certificate) error {
+	err := p.checkCertificate(cert)
+	if err != nil && !p.enforce {
+		logWarn("local certificate does not match the TLS policy", "error", err)
+		return nil
+	}
+	return err
+}
+
+// certSignatureOID returns the signature algorithm OID of a certificate,
+// read from the DER so that algorithms unknown to crypto/x509 are named.
+func certSignatureOID(cert *x509.Certificate) (asn1.ObjectIdentifier, error) {
+	var outer struct {
+		TBS       asn1.RawValue
+		Algorithm pkix.AlgorithmIdentifier
+		Signature asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(cert.Raw, &outer); err != nil {
+		return nil, err
+	}
+	return outer.Algorithm.Algorithm, nil
+}
+
+// report returns the effective policy as log fields.
+func (p *tlsPolicy) report() []interface{} {
+	var ciphers, curves []string
+	for _, id := range p.ciphers {
+		ciphers = append(ciphers, cipherSuiteName(id))
+	}
+	for _, curve := range p.curves {
+		curves = append(curves, curveName(curve))
+	}
+	if len(ciphers) == 0 {
+		ciphers = []string{"default"}
+	}
+	if len(curves) == 0 {
+		curves = []string{"default"}
+	}
+	return []interface{}{"profile", p.profile, "versions", versionName(p.minVersion) + "-" + versionName(p.maxVersion),
+		"ciphers", strings.Join(ciphers, ","), "curves", strings.Join(curves, ","), "sigalgs", strings.Join(p.sigAlgs, ",")}
+}
+
+// describeConnection summarizes the negotiated version, cipher suite, key
+// exchange and peer certificate signature of a connection.
+func describeConnection(state tls.ConnectionState) string {
+	suite := cipherSuiteName(state.CipherSuite)
+	_, gost := gostCipherSuites[suite]
+
+	var kex string
+	switch {
+	case gost:
+		kex = "VKO GOST R 34.10-2012"
+	case state.Version == tls.VersionTLS13 || strings.Contains(suite, "_ECDHE_"):
+		kex = "ECDHE"
+	default:
+		kex = "RSA"
+	}
+
+	description := fmt.Sprintf("TLS %s, cipher suite %s, key exchange %s", versionName(state.Version), suite, kex)
+	if len(state.PeerCertificates) > 0 {
+		if oid, err := certSignatureOID(state.PeerCertificates[0]); err == nil {
+			description += ", peer certificate signed with " + sigAlgName(oid)
+		}
+	}
+	return description
+}
+
+func sigAlgName(oid asn1.ObjectIdentifier) string {
+	for name, id := range sigAlgOIDs {
+		if id.Equal(oid) {
+			return name
+		}
+	}
+	return oid.String()
+}
+
+func versionName(version uint16) string {
+	for name, v := range tlsVersions {
+		if v == version {
+			return name
+		}
+	}
+	return fmt.Sprintf("0x%04X", version)
+}
+
+func cipherSuiteName(id uint16) string {
+	for name, gostID := range gostCipherSuites {
+		if gostID == id {
+			return name
+		}
+	}
+	return tls.CipherSuiteName(id)
+}
+
+func curveName(curve tls.CurveID) string {
+	for name, id := range curveIDs {
+		if id == curve {
+			return name
+		}
+	}
+	return fmt.Sprintf("0x%04X", uint16(curve))
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pedroalbanese/gogost/gost3410"
+)
+
+// testPolicy builds the TLS policy of a profile, with extra flags.
+func testPolicy(t *testing.T, profile string, flags ...string) *tlsPolicy {
+	t.Helper()
+	for _, name := range []string{"tlsmin", "tlsmax", "tlsciphers", "tlscurves", "tlssigalgs"} {
+		setFlag(t, name, "")
+	}
+	setFlag(t, "tlsprofile", profile)
+	for i := 0; i+1 < len(flags); i += 2 {
+		setFlag(t, flags[i], flags[i+1])
+	}
+	policy, err := newTLSPolicy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return policy
+}
+
+// handshake connects a client to a server over net.Pipe, each side with
+// its own policy and certificate, and returns the first error.
+func handshake(server, client *tlsPolicy, serverCert, clientCert tls.Certificate) error {
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	}
+	server.apply(serverConfig)
+	clientConfig := &tls.Config{
+		Certificates:       []tls.Certificate{clientCert},
+		InsecureSkipVerify: true,
+	}
+	client.apply(clientConfig)
+
+	serverSide, clientSide := net.Pipe()
+	defer serverSide.Close()
+	defer clientSide.Close()
+	serverSide.SetDeadline(time.Now().Add(10 * time.Second))
+	clientSide.SetDeadline(time.Now().Add(10 * time.Second))
+
+	errs := make(chan error, 1)
+	go func() {
+		err := tls.Server(serverSide, serverConfig).Handshake()
+		serverSide.Close()
+		errs <- err
+	}()
+	clientErr := tls.Client(clientSide, clientConfig).Handshake()
+	clientSide.Close()
+	serverErr := <-errs
+	if serverErr != nil {
+		return serverErr
+	}
+	return clientErr
+}
+
+// keyPair creates a self-signed key pair, or skips the test if the TLS
+// stack cannot create one of this kind.
+func keyPair(t *testing.T, c testCert) tls.Certificate {
+	t.Helper()
+	cert, key, err := createTestCert(c)
+	if err != nil {
+		t.Skipf("cannot create certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key, Leaf: cert}
+}
+
+// gostKeyPair creates a GOST R 34.10-2012 key pair, or skips the test on a
+// toolchain without GOST support in crypto/x509 and crypto/tls.
+func gostKeyPair(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+	key, err := gost3410.GenPrivateKey(gost3410.CurveIdtc26gost34102012256paramSetA(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _, err := createTestCert(testCert{subject: name, key: key})
+	if err != nil {
+		t.Skipf("no GOST certificate support in this toolchain: %v", err)
+	}
+	if _, ok := cert.PublicKey.(*gost3410.PublicKey); !ok {
+		t.Skip("no GOST certificate support in this toolchain")
+	}
+	return tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key, Leaf: cert}
+}
+
+func TestTLSProfilesWithECDSA(t *testing.T) {
+	server := keyPair(t, testCert{subject: "localhost"})
+	client := keyPair(t, testCert{subject: "alice"})
+
+	for _, tt := range []struct {
+		profile string
+		ok      bool
+	}{
+		{"modern", true},
+		{"compat", true},
+		{"gost-only", false},
+	} {
+		policy := testPolicy(t, tt.profile)
+		err := handshake(policy, policy, server, client)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: handshake error %v, want success %v", tt.profile, err, tt.ok)
+		}
+		if err := policy.checkLocalCertificate(server.Leaf); (err == nil) != tt.ok {
+			t.Errorf("%s: local certificate check: %v", tt.profile, err)
+		}
+	}
+}
+
+func TestTLSProfilesWithSHA1Certificate(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := keyPair(t, testCert{subject: "localhost"})
+	client := keyPair(t, testCert{subject: "old", key: rsaKey, sigAlg: x509.SHA1WithRSA})
+
+	modern := testPolicy(t, "modern")
+	if err := handshake(modern, modern, server, client); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("modern: SHA-1 signed client certificate not refused by the policy: %v", err)
+	}
+	compat := testPolicy(t, "compat")
+	if err := handshake(compat, compat, server, client); err != nil {
+		t.Errorf("compat: %v", err)
+	}
+	// The certificate list can be narrowed below the profile
+	narrow := testPolicy(t, "compat", "tlssigalgs", "ed25519")
+	if err := handshake(narrow, compat, server, client); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("-tlssigalgs ed25519: RSA client certificate not refused by the policy: %v", err)
+	}
+}
+
+func TestTLSProfileVersions(t *testing.T) {
+	server := keyPair(t, testCert{subject: "localhost"})
+	client := keyPair(t, testCert{subject: "alice"})
+	oldClient := testPolicy(t, "compat", "tlsmax", "1.2")
+
+	if err := handshake(testPolicy(t, "modern"), oldClient, server, client); err == nil {
+		t.Error("modern: accepted a TLS 1.2 client")
+	}
+	if err := handshake(testPolicy(t, "compat"), oldClient, server, client); err != nil {
+		t.Errorf("compat: TLS 1.2 client refused: %v", err)
+	}
+}
+
+func TestTLSProfilesWithGOST(t *testing.T) {
+	server := gostKeyPair(t, "localhost")
+	client := gostKeyPair(t, "alice")
+	gost := testPolicy(t, "gost-only")
+
+	if err := handshake(gost, gost, server, client); err != nil {
+		t.Fatalf("gost-only: %v", err)
+	}
+	if err := gost.checkLocalCertificate(server.Leaf); err != nil {
+		t.Errorf("gost-only: local certificate check: %v", err)
+	}
+
+	// A GOST-only server has nothing in common with a modern client
+	if err := handshake(gost, testPolicy(t, "modern"), server, client); err == nil {
+		t.Error("gost-only server accepted a modern client")
+	}
+	// nor does it accept a non-GOST certificate
+	ecdsaClient := keyPair(t, testCert{subject: "bob"})
+	if err := handshake(gost, gost, server, ecdsaClient); err == nil {
+		t.Error("gost-only server accepted an ECDSA client certificate")
+	}
+}
+
+func TestTLSPolicyFlagErrors(t *testing.T) {
+	for _, flags := range [][]string{
+		{"tlsprofile", "legacy"},
+		{"tlsmin", "1.4"},
+		{"tlsmin", "1.3", "tlsmax", "1.2"},
+		{"tlsciphers", "TLS_NULL"},
+		{"tlscurves", "P-192"},
+		{"tlssigalgs", "md5"},
+	} {
+		for _, name := range []string{"tlsprofile", "tlsmin", "tlsmax", "tlsciphers", "tlscurves", "tlssigalgs"} {
+			setFlag(t, name, "")
+		}
+		setFlag(t, "tlsprofile", "modern")
+		for i := 0; i+1 < len(flags); i += 2 {
+			setFlag(t, flags[i], flags[i+1])
+		}
+		if _, err := newTLSPolicy(); err == nil {
+			t.Errorf("%v: accepted", flags)
+		}
+	}
+}
@@ -0,0 +1,852 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/pedroalbanese/color"
+	"github.com/pedroalbanese/readline"
+)
+
+// The full-screen client keeps a window per joined room, and a status
+// window for everything else, laid out as
+//
+//	 localhost:8000  TLS 1.3, cipher suite TLS_AES_128_GCM_SHA256, ...
+//	 15:04 @bob: hello                        │ Windows
+//	 15:05 @alice: hi                         │  1 status
+//	                                          │  2 Home
+//	                                          │  3 Dev (2)
+//	                                          │
+//	                                          │ Users (2)
+//	                                          │  @alice
+//	                                          │  @bob
+//	 [15:05] [@alice] [2:Home] [Act: 3]
+//	 [Home] _
+//
+// Text typed in a room window is sent to that room with MSG, commands as
+// they are.
+
+// Terminal styles of the interface
+const (
+	styleDim     = "\x1b[90m"
+	styleRoom    = "\x1b[96m"
+	styleNick    = "\x1b[97;1m"
+	styleSelf    = "\x1b[92;1m"
+	styleMention = "\x1b[93;1m"
+	styleWarning = "\x1b[91;1m"
+	styleBar     = "\x1b[7m"
+)
+
+// Lines kept per window, and width of the sidebar
+const (
+	scrollback   = 2000
+	sidebarWidth = 20
+)
+
+// Commands sent as they are from a room window
+var commandNames = map[string]bool{
+	"JOIN": true, "LEAVE": true, "MSG": true, "LIST": true, "NAMES": true, "NOTICES": true,
+	"NICK": true, "WHOIS": true, "CERTINFO": true, "SESSIONS": true, "KILLSESSION": true,
+	"KICK": true, "ENROLL": true, "QUIT": true, "CONTACTS": true, "SAFETY": true, "VERIFY": true,
+	"KEYOF": true, "WALLOPS": true, "ANNOUNCE": true, "KILL": true, "BAN": true, "UNBAN": true,
+	"BANS": true, "TAKEOVER": true, "CONFIG": true,
+}
+
+// span is text drawn in one style.
+type span struct {
+	style string
+	text  string
+}
+
+// window is a joined room, or the status window when room is "".
+type window struct {
+	room    string
+	lines   [][]span
+	members map[string]bool
+	unread  int
+	mention bool
+	scroll  int // rows scrolled back from the bottom
+}
+
+type tui struct {
+	mu       sync.Mutex
+	out      io.Writer
+	conn     io.Writer
+	cert     tls.Certificate
+	contacts *contactStore
+	title    string
+	width    int
+	height   int
+	windows  []*window
+	active   int
+	nick     string
+	listing  *window // the room whose user list is being received
+	offline  bool
+	quit     bool
+	input    []rune
+	cursor   int
+	history  []string
+	recall   int    // position in history while browsing it
+	draft    []rune // the line typed before browsing history
+	status   string // the status bar on screen
+}
+
+// useTUI reports whether to run the full-screen client: when stdin and
+// stdout are terminals, unless -plain is given.
+func useTUI() bool {
+	return !*plainUI && readline.IsTerminal(int(os.Stdin.Fd())) && readline.IsTerminal(int(os.Stdout.Fd()))
+}
+
+// runTUI runs the full-screen client until the user quits.
+func runTUI(client *Client, cert tls.Certificate, contacts *contactStore, state tls.ConnectionState) error {
+	fd := int(os.Stdin.Fd())
+	saved, err := readline.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer readline.Restore(fd, saved)
+
+	t := &tui{
+		out:      color.Output,
+		conn:     client.conn,
+		cert:     cert,
+		contacts: contacts,
+		title:    printable(*serverAddr + "  " + describeConnection(state)),
+		windows:  []*window{{members: make(map[string]bool)}},
+	}
+	t.resize()
+	readline.DefaultOnWidthChanged(func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.resize()
+		t.draw()
+	})
+
+	// Use the alternate screen, and show log lines in the current window
+	fmt.Fprint(t.out, "\x1b[?1049h")
+	log.SetOutput(t)
+	log.SetFlags(0)
+	defer func() {
+		t.mu.Lock()
+		t.quit = true
+		t.mu.Unlock()
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+		fmt.Fprint(t.out, "\x1b[?25h\x1b[?1049l")
+	}()
+
+	// Our name comes back from a lookup of our own key
+	client.conn.Write([]byte(contacts.lookupSelf() + "\n"))
+	go func() {
+		readMessages(client, contacts, t)
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.offline = true
+		t.draw()
+	}()
+	go func() {
+		// Keep the clock and the name in the status bar current
+		for range time.Tick(time.Second) {
+			t.mu.Lock()
+			if t.statusBar() != t.status {
+				t.draw()
+			}
+			t.mu.Unlock()
+		}
+	}()
+
+	t.mu.Lock()
+	t.draw()
+	t.mu.Unlock()
+
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		r, _, err := reader.ReadRune()
+		if err != nil {
+			return nil
+		}
+		var seq string
+		if r == 0x1b {
+			seq = readEscape(reader)
+		}
+
+		t.mu.Lock()
+		line, entered := t.key(r, seq)
+		quit := t.quit
+		t.draw()
+		t.mu.Unlock()
+
+		if entered {
+			quit = t.submit(line)
+		}
+		if quit {
+			client.conn.Write([]byte("QUIT\n"))
+			return nil
+		}
+	}
+}
+
+// readEscape reads the rest of an escape sequence: "[A" for the up arrow,
+// "[5~" for page up, or a single character for Alt and a key.
+func readEscape(reader *bufio.Reader) string {
+	r, _, err := reader.ReadRune()
+	if err != nil {
+		return ""
+	}
+	if r != '[' && r != 'O' {
+		return string(r)
+	}
+	seq := []rune{r}
+	for {
+		r, _, err := reader.ReadRune()
+		if err != nil {
+			return string(seq)
+		}
+		seq = append(seq, r)
+		if r >= 0x40 && r <= 0x7e {
+			return string(seq)
+		}
+	}
+}
+
+// key applies a key to the input line and returns the line when the user
+// enters it.
+func (t *tui) key(r rune, seq string) (string, bool) {
+	switch r {
+	case 0x1b:
+		switch seq {
+		case "[A", "OA":
+			t.browse(-1)
+		case "[B", "OB":
+			t.browse(1)
+		case "[C", "OC":
+			t.move(t.cursor + 1)
+		case "[D", "OD":
+			t.move(t.cursor - 1)
+		case "[H", "OH", "[1~", "[7~":
+			t.move(0)
+		case "[F", "OF", "[4~", "[8~":
+			t.move(len(t.input))
+		case "[3~":
+			t.erase(t.cursor, t.cursor+1)
+		case "[5~":
+			t.windows[t.active].scroll += t.paneHeight() / 2
+		case "[6~":
+			if w := t.windows[t.active]; w.scroll > t.paneHeight()/2 {
+				w.scroll -= t.paneHeight() / 2
+			} else {
+				w.scroll = 0
+			}
+		default:
+			// Alt-1 to Alt-9 switch windows
+			if len(seq) == 1 && seq[0] >= '1' && seq[0] <= '9' {
+				t.activate(int(seq[0] - '1'))
+			}
+		}
+	case '\r', '\n':
+		line := strings.TrimSpace(string(t.input))
+		t.input, t.cursor, t.draft = nil, 0, nil
+		if line != "" && (len(t.history) == 0 || t.history[len(t.history)-1] != line) {
+			t.history = append(t.history, line)
+		}
+		t.recall = len(t.history)
+		return line, line != ""
+	case 0x7f, 0x08: // Backspace
+		t.erase(t.cursor-1, t.cursor)
+	case 0x01: // Ctrl-A
+		t.move(0)
+	case 0x05: // Ctrl-E
+		t.move(len(t.input))
+	case 0x02: // Ctrl-B
+		t.move(t.cursor - 1)
+	case 0x06: // Ctrl-F
+		t.move(t.cursor + 1)
+	case 0x0b: // Ctrl-K
+		t.erase(t.cursor, len(t.input))
+	case 0x15: // Ctrl-U
+		t.erase(0, t.cursor)
+	case 0x17: // Ctrl-W
+		start := t.cursor
+		for start > 0 && t.input[start-1] == ' ' {
+			start--
+		}
+		for start > 0 && t.input[start-1] != ' ' {
+			start--
+		}
+		t.erase(start, t.cursor)
+	case 0x0e: // Ctrl-N
+		t.activate((t.active + 1) % len(t.windows))
+	case 0x10: // Ctrl-P
+		t.activate((t.active + len(t.windows) - 1) % len(t.windows))
+	case 0x0c: // Ctrl-L, the screen is redrawn anyway
+	case 0x03: // Ctrl-C
+		t.quit = true
+	case 0x04: // Ctrl-D
+		if len(t.input) == 0 {
+			t.quit = true
+		}
+		t.erase(t.cursor, t.cursor+1)
+	case '\t':
+		t.complete()
+	default:
+		if unicode.IsPrint(r) {
+			t.input = append(t.input[:t.cursor], append([]rune{r}, t.input[t.cursor:]...)...)
+			t.cursor++
+		}
+	}
+	return "", false
+}
+
+func (t *tui) move(cursor int) {
+	if cursor >= 0 && cursor <= len(t.input) {
+		t.cursor = cursor
+	}
+}
+
+// erase removes the input between start and end.
+func (t *tui) erase(start, end int) {
+	if start < 0 || end > len(t.input) || start >= end {
+		return
+	}
+	t.input = append(t.input[:start], t.input[end:]...)
+	t.cursor = start
+}
+
+// browse moves through the history of entered lines.
+func (t *tui) browse(step int) {
+	recall := t.recall + step
+	if recall < 0 || recall > len(t.history) {
+		return
+	}
+	if t.recall == len(t.history) {
+		t.draft = t.input
+	}
+	t.recall = recall
+	if recall == len(t.history) {
+		t.input = t.draft
+	} else {
+		t.input = []rune(t.history[recall])
+	}
+	t.cursor = len(t.input)
+}
+
+// complete completes the nickname before the cursor from the users of the
+// current room.
+func (t *tui) complete() {
+	start := t.cursor
+	for start > 0 && t.input[start-1] != ' ' {
+		start--
+	}
+	prefix := strings.ToLower(strings.TrimPrefix(string(t.input[start:t.cursor]), "@"))
+	if prefix == "" {
+		return
+	}
+	for _, name := range sortedMembers(t.windows[t.active]) {
+		if strings.HasPrefix(strings.ToLower(strings.TrimPrefix(name, "@")), prefix) {
+			completed := []rune(name + " ")
+			t.input = append(t.input[:start], append(completed, t.input[t.cursor:]...)...)
+			t.cursor = start + len(completed)
+			return
+		}
+	}
+}
+
+// activate switches to the window numbered i from 0.
+func (t *tui) activate(i int) {
+	if i < 0 || i >= len(t.windows) {
+		return
+	}
+	t.active = i
+	t.windows[i].unread, t.windows[i].mention = 0, false
+}
+
+// submit sends a line the user entered and reports whether the user quit.
+func (t *tui) submit(line string) bool {
+	t.mu.Lock()
+	w := t.windows[t.active]
+	w.scroll = 0
+	message := line
+	word, rest, _ := strings.Cut(line, " ")
+	switch {
+	case w.room == "":
+	case !commandNames[word]:
+		message = "MSG " + w.room + " " + line
+	case (word == "LEAVE" || word == "LIST" || word == "NAMES") && rest == "":
+		message = word + " " + w.room
+	}
+
+	if strings.HasPrefix(message, "MSG ") {
+		room, text, _ := strings.Cut(strings.TrimPrefix(message, "MSG "), " ")
+		if target := t.window(room, false); target != nil {
+			w = target
+		}
+		t.add(w, []span{{styleDim, stamp()}, {styleSelf, t.selfName()}, {"", ": " + text}}, false)
+	} else {
+		t.add(w, []span{{styleDim, stamp()}, {styleDim, line}}, false)
+	}
+	t.draw()
+	t.mu.Unlock()
+
+	if message == "QUIT" {
+		return true
+	}
+	if message, ok := clientCommand(message, t.cert, t.contacts, t); ok {
+		if _, err := t.conn.Write([]byte(message + "\n")); err != nil {
+			log.Println("Error sending message:", err)
+		}
+	}
+	return false
+}
+
+// show handles a line from the server.
+func (t *tui) show(message string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	message = printable(strings.TrimRight(message, "\r\n"))
+	if room, text, ok := splitRoomTag(message); ok {
+		t.showRoom(t.window(room, true), text)
+		t.draw()
+		return
+	}
+
+	line := []span{{styleDim, stamp()}, {"", message}}
+	if isListMessage(message) {
+		line = []span{{"", message}}
+	}
+	target := t.windows[t.active]
+	switch {
+	case strings.HasPrefix(message, "Joined room: "):
+		room := strings.TrimPrefix(message, "Joined room: ")
+		target = t.window(room, true)
+		t.activate(t.index(target))
+		go t.conn.Write([]byte("NAMES " + room + "\n"))
+	case strings.HasPrefix(message, "Current room: "):
+		if w := t.window(strings.TrimPrefix(message, "Current room: "), false); w != nil {
+			t.activate(t.index(w))
+		}
+	case strings.HasPrefix(message, "Left room: "):
+		t.close(strings.TrimPrefix(message, "Left room: "))
+		target = t.windows[0]
+	case strings.HasPrefix(message, "Users in the chat (") && strings.HasSuffix(message, "):"):
+		room := strings.TrimSuffix(strings.TrimPrefix(message, "Users in the chat ("), "):")
+		if t.listing = t.window(room, false); t.listing != nil {
+			t.listing.members = make(map[string]bool)
+		}
+	case strings.HasPrefix(message, "- ") && t.listing != nil:
+		t.listing.members[strings.TrimPrefix(message, "- ")] = true
+	case strings.HasPrefix(message, "You are now known as "):
+		nick := strings.TrimSuffix(strings.TrimPrefix(message, "You are now known as "), ".")
+		t.rename(t.selfName(), nick)
+		t.nick = nick
+	case strings.Contains(message, " left the chat at "):
+		name, _, _ := strings.Cut(message, " ")
+		for _, w := range t.windows {
+			delete(w.members, name)
+		}
+		line[1].style = styleDim
+	case strings.Contains(message, " joined the chat at "):
+		line[1].style = styleDim
+	}
+	if !strings.HasPrefix(message, "- ") && !strings.HasPrefix(message, "Users in the chat (") {
+		t.listing = nil
+	}
+	t.add(target, line, false)
+	t.draw()
+}
+
+// showRoom handles a "[room] " line from the server.
+func (t *tui) showRoom(w *window, text string) {
+	at := span{styleDim, stamp()}
+	// Chat lines first: their text could look like any notice
+	switch {
+	case strings.HasPrefix(text, "@") && strings.Contains(text, "# "):
+		sender, body, _ := strings.Cut(text, "# ")
+		style := styleNick
+		if nick := strings.TrimPrefix(t.selfName(), "@"); nick != "" && strings.Contains(strings.ToLower(body), strings.ToLower(nick)) {
+			style = styleMention
+			if w != t.windows[t.active] {
+				w.mention = true
+			}
+		}
+		t.add(w, []span{at, {style, sender}, {"", ": " + body}}, true)
+	case strings.HasSuffix(text, " joined the room."):
+		w.members[strings.TrimSuffix(text, " joined the room.")] = true
+		t.add(w, []span{at, {styleDim, text}}, false)
+	case strings.HasSuffix(text, " left the room."):
+		delete(w.members, strings.TrimSuffix(text, " left the room."))
+		t.add(w, []span{at, {styleDim, text}}, false)
+	case strings.Contains(text, " is now known as "):
+		if old, nick, ok := parseRename(text); ok {
+			t.rename(old, nick)
+		}
+		t.add(w, []span{at, {styleDim, text}}, false)
+	default:
+		t.add(w, []span{at, {"", text}}, true)
+	}
+}
+
+// notify shows a line from the client itself in the current window.
+func (t *tui) notify(message string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, text := range strings.Split(message, "\n") {
+		prefix := stamp()
+		if i > 0 {
+			prefix = strings.Repeat(" ", len(prefix))
+		}
+		t.add(t.windows[t.active], []span{{styleDim, prefix}, {"", printable(text)}}, false)
+	}
+	t.draw()
+}
+
+// warn shows a warning in the current window.
+func (t *tui) warn(message string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.add(t.windows[t.active], []span{{styleDim, stamp()}, {styleWarning, printable(message)}}, false)
+	t.draw()
+}
+
+// Write shows log lines in the current window.
+func (t *tui) Write(p []byte) (int, error) {
+	t.notify(strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
+
+// printable drops the runes that cannot be shown, so that text from peers
+// cannot carry escape sequences or other control characters to the
+// terminal.
+func printable(s string) string {
+	return strings.Map(func(r rune) rune {
+		if !unicode.IsPrint(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// splitRoomTag splits a "[room] text" line.
+func splitRoomTag(message string) (string, string, bool) {
+	if !strings.HasPrefix(message, "[") {
+		return "", "", false
+	}
+	i := strings.Index(message, "] ")
+	if i < 0 {
+		return "", "", false
+	}
+	return message[1:i], message[i+2:], true
+}
+
+func stamp() string {
+	return time.Now().Format("15:04") + " "
+}
+
+// window returns the window of a room, creating it if asked to.
+func (t *tui) window(room string, create bool) *window {
+	for _, w := range t.windows[1:] {
+		if w.room == room {
+			return w
+		}
+	}
+	if !create {
+		return nil
+	}
+	w := &window{room: room, members: make(map[string]bool)}
+	t.windows = append(t.windows, w)
+	return w
+}
+
+func (t *tui) index(w *window) int {
+	for i := range t.windows {
+		if t.windows[i] == w {
+			return i
+		}
+	}
+	return 0
+}
+
+// close removes the window of a room the user left.
+func (t *tui) close(room string) {
+	w := t.window(room, false)
+	if w == nil {
+		return
+	}
+	i := t.index(w)
+	t.windows = append(t.windows[:i], t.windows[i+1:]...)
+	switch {
+	case t.active == i:
+		t.activate(0)
+	case t.active > i:
+		t.active--
+	}
+}
+
+// rename follows a nickname change in the user lists.
+func (t *tui) rename(old, nick string) {
+	for _, w := range t.windows {
+		if w.members[old] {
+			delete(w.members, old)
+			w.members[nick] = true
+		}
+	}
+}
+
+// selfName returns our nickname, once known.
+func (t *tui) selfName() string {
+	if t.nick != "" {
+		return t.nick
+	}
+	return t.contacts.selfName()
+}
+
+// add appends a line to a window, counting it as unread if asked to and
+// the window is not shown.
+func (t *tui) add(w *window, line []span, unread bool) {
+	w.lines = append(w.lines, line)
+	if len(w.lines) > scrollback {
+		w.lines = w.lines[len(w.lines)-scrollback:]
+	}
+	if w.scroll > 0 {
+		// Keep the scrolled back text in place
+		w.scroll += len(wrap(line, t.paneWidth()))
+	}
+	if unread && w != t.windows[t.active] {
+		w.unread++
+	}
+}
+
+func (t *tui) resize() {
+	width, height, err := readline.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width <= 0 || height <= 0 {
+		width, height = 80, 24
+	}
+	t.width, t.height = width, height
+	t.status = ""
+}
+
+func (t *tui) paneWidth() int {
+	if t.width >= 3*sidebarWidth {
+		return t.width - sidebarWidth - 1
+	}
+	return t.width
+}
+
+func (t *tui) paneHeight() int {
+	return t.height - 3
+}
+
+// statusBar describes the clock, our name, the current window, windows
+// with unread lines and whether the view is scrolled back.
+func (t *tui) statusBar() string {
+	w := t.windows[t.active]
+	name := w.room
+	if name == "" {
+		name = "status"
+	}
+	bar := fmt.Sprintf(" [%s] [%s] [%d:%s]", time.Now().Format("15:04"), t.selfName(), t.active+1, name)
+	var act []string
+	for i, w := range t.windows {
+		if w.mention {
+			act = append(act, fmt.Sprintf("%d!", i+1))
+		} else if w.unread > 0 {
+			act = append(act, fmt.Sprint(i+1))
+		}
+	}
+	if len(act) > 0 {
+		bar += " [Act: " + strings.Join(act, ",") + "]"
+	}
+	if w.scroll > 0 {
+		bar += " [more]"
+	}
+	if t.offline {
+		bar += " [disconnected]"
+	}
+	return bar
+}
+
+// sidebar lists the windows, with their unread lines, and the users of the
+// current room.
+func (t *tui) sidebar() [][]span {
+	rows := [][]span{{{styleNick, "Windows"}}}
+	for i, w := range t.windows {
+		name := w.room
+		if name == "" {
+			name = "status"
+		}
+		style := ""
+		switch {
+		case i == t.active:
+			style = styleBar
+		case w.mention:
+			style = styleMention
+		case w.unread > 0:
+			style = styleNick
+		}
+		text := fmt.Sprintf("%2d %s", i+1, name)
+		if w.unread > 0 {
+			text += fmt.Sprintf(" (%d)", w.unread)
+		}
+		rows = append(rows, []span{{style, text}})
+	}
+	if w := t.windows[t.active]; w.room != "" {
+		rows = append(rows, nil, []span{{styleNick, fmt.Sprintf("Users (%d)", len(w.members))}})
+		for _, name := range sortedMembers(w) {
+			style := ""
+			if name == t.selfName() {
+				style = styleSelf
+			}
+			rows = append(rows, []span{{style, " " + name}})
+		}
+	}
+	return rows
+}
+
+func sortedMembers(w *window) []string {
+	names := make([]string, 0, len(w.members))
+	for name := range w.members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// draw redraws the whole screen.
+func (t *tui) draw() {
+	if t.quit || t.width < 20 || t.height < 5 {
+		return
+	}
+	var b strings.Builder
+	b.WriteString("\x1b[?25l")
+	fmt.Fprintf(&b, "\x1b[1;1H%s", fit([]span{{styleBar, " " + t.title}}, t.width, styleBar))
+
+	paneWidth, height := t.paneWidth(), t.paneHeight()
+	rows := t.paneRows(t.windows[t.active], paneWidth, height)
+	side := t.sidebar()
+	for i := 0; i < height; i++ {
+		var pane, extra []span
+		if i >= height-len(rows) {
+			pane = rows[i-(height-len(rows))]
+		}
+		fmt.Fprintf(&b, "\x1b[%d;1H%s", i+2, fit(pane, paneWidth, ""))
+		if paneWidth < t.width {
+			if i < len(side) {
+				extra = side[i]
+			}
+			fmt.Fprintf(&b, "%s│\x1b[0m%s", styleDim, fit(extra, t.width-paneWidth-1, ""))
+		}
+	}
+
+	t.status = t.statusBar()
+	fmt.Fprintf(&b, "\x1b[%d;1H%s", t.height-1, fit([]span{{styleBar, t.status}}, t.width, styleBar))
+
+	// The input line scrolls sideways to keep the cursor in view
+	prompt := "[status] "
+	if room := t.windows[t.active].room; room != "" {
+		prompt = "[" + room + "] "
+	}
+	avail := t.width - len([]rune(prompt)) - 1
+	start := 0
+	if t.cursor > avail {
+		start = t.cursor - avail
+	}
+	end := len(t.input)
+	if end > start+avail {
+		end = start + avail
+	}
+	input := []span{{styleRoom, prompt}, {"", string(t.input[start:end])}}
+	fmt.Fprintf(&b, "\x1b[%d;1H%s", t.height, fit(input, t.width, ""))
+	fmt.Fprintf(&b, "\x1b[%d;%dH\x1b[?25h", t.height, len([]rune(prompt))+t.cursor-start+1)
+	io.WriteString(t.out, b.String())
+}
+
+// paneRows returns the rows of a window that fit in the pane, keeping the
+// scroll position within the text.
+func (t *tui) paneRows(w *window, width, height int) [][]span {
+	var rows [][]span
+	for i := len(w.lines) - 1; i >= 0 && len(rows) < height+w.scroll; i-- {
+		rows = append(wrap(w.lines[i], width), rows...)
+	}
+	if w.scroll > len(rows)-height {
+		w.scroll = len(rows) - height
+	}
+	if w.scroll < 0 {
+		w.scroll = 0
+	}
+	end := len(rows) - w.scroll
+	if end > height {
+		return rows[end-height : end]
+	}
+	return rows[:end]
+}
+
+// wrap breaks a line into rows of width characters, at spaces if it can.
+func wrap(line []span, width int) [][]span {
+	var runes []rune
+	var styles []string
+	for _, s := range line {
+		for _, r := range s.text {
+			runes = append(runes, r)
+			styles = append(styles, s.style)
+		}
+	}
+	if width <= 0 {
+		return nil
+	}
+
+	var rows [][]span
+	for len(runes) > width {
+		cut := width
+		for i := width; i > 0; i-- {
+			if runes[i] == ' ' {
+				cut = i
+				break
+			}
+		}
+		rows = append(rows, spans(runes[:cut], styles[:cut]))
+		runes, styles = runes[cut:], styles[cut:]
+		for len(runes) > 0 && runes[0] == ' ' {
+			runes, styles = runes[1:], styles[1:]
+		}
+	}
+	return append(rows, spans(runes, styles))
+}
+
+// spans groups runes of the same style.
+func spans(runes []rune, styles []string) []span {
+	var row []span
+	for i, r := range runes {
+		if n := len(row); n > 0 && row[n-1].style == styles[i] {
+			row[n-1].text += string(r)
+		} else {
+			row = append(row, span{styles[i], string(r)})
+		}
+	}
+	return row
+}
+
+// fit draws a row cut or padded to width, padding in the fill style.
+func fit(row []span, width int, fill string) string {
+	var b strings.Builder
+	for _, s := range row {
+		text := []rune(s.text)
+		if len(text) > width {
+			text = text[:width]
+		}
+		width -= len(text)
+		b.WriteString(s.style + string(text) + "\x1b[0m")
+	}
+	if width > 0 {
+		b.WriteString(fill + strings.Repeat(" ", width) + "\x1b[0m")
+	}
+	return b.String()
+}
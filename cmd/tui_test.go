@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestTUIDropsControlCharacters(t *testing.T) {
+	ui := &tui{
+		out:     io.Discard,
+		conn:    io.Discard,
+		nick:    "@alice",
+		windows: []*window{{members: make(map[string]bool)}},
+	}
+	ui.show("[#room\x1b[2J] @eve\x1b[31m# hi\x1b]0;owned\x07 there\r")
+	ui.show("[#room\x1b[2J] @mallory\x1b[8m joined the room.")
+	ui.show("Notice\x1b[?1049l from the server\x00")
+	ui.notify("peer said\x1b[H\nsecond\u009b line")
+	ui.warn("key changed for @eve\x1b[5m")
+
+	var text []string
+	for _, w := range ui.windows {
+		text = append(text, w.room)
+		for name := range w.members {
+			text = append(text, name)
+		}
+		for _, line := range w.lines {
+			for _, s := range line {
+				text = append(text, s.text)
+			}
+		}
+	}
+	all := strings.Join(text, "|")
+	for _, r := range all {
+		if r < 0x20 || r == 0x7f || (r >= 0x80 && r < 0xa0) {
+			t.Fatalf("control character %U stored: %q", r, all)
+		}
+	}
+	for _, want := range []string{"#room[2J", "@eve[31m", ": hi]0;owned there", "@mallory[8m", "Notice[?1049l from the server", "second line"} {
+		if !strings.Contains(all, want) {
+			t.Errorf("%q missing from %q", want, all)
+		}
+	}
+}
+
+func TestPrintable(t *testing.T) {
+	for in, want := range map[string]string{
+		"hello, world":          "hello, world",
+		"naïve café ☕ 日本語":      "naïve café ☕ 日本語",
+		"tab\tand\nnewline\r":   "tabandnewline",
+		"\x1b[31mred\x1b[0m":    "[31mred[0m",
+		"bell\x07 del\x7f":      "bell del",
+		"c1\u009b2J bidi\u202e": "c12J bidi",
+		"zero\u200bwidth":       "zerowidth",
+		"raw \x9b byte":         "raw \ufffd byte",
+	} {
+		if got := printable(in); got != want {
+			t.Errorf("printable(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestTUIChatTextIsNotANotice(t *testing.T) {
+	ui := &tui{
+		out:     io.Discard,
+		conn:    io.Discard,
+		nick:    "@alice",
+		windows: []*window{{members: make(map[string]bool)}},
+	}
+	ui.show("[#room] @bob joined the room.")
+	ui.show("[#room] @eve# @mallory joined the room.")
+	ui.show("[#room] @eve# @bob is now known as @eve.")
+	w := ui.window("#room", false)
+	if len(w.members) != 1 || !w.members["@bob"] {
+		t.Errorf("members %v, want only @bob", w.members)
+	}
+
+	ui.show("[#room] @bob is now known as @robert.")
+	if len(w.members) != 1 || !w.members["@robert"] {
+		t.Errorf("members %v after a rename, want only @robert", w.members)
+	}
+}
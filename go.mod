@@ -3,13 +3,19 @@ module ircs
 go 1.20
 
 require (
+	github.com/ThalesIgnite/crypto11 v1.2.5
+	github.com/emmansun/gmsm v0.15.5
 	github.com/pedroalbanese/color v1.13.1
 	github.com/pedroalbanese/readline v0.0.0-20230606221617-b6617a44b8e7
+	golang.org/x/crypto v0.9.0
 )
 
 require (
 	github.com/chzyer/test v1.0.0 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.17 // indirect
+	github.com/miekg/pkcs11 v1.0.3-0.20190429190417-a667d056470f // indirect
+	github.com/pkg/errors v0.8.1 // indirect
+	github.com/thales-e-security/pool v0.0.2 // indirect
 	golang.org/x/sys v0.8.0 // indirect
 )